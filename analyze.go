@@ -0,0 +1,45 @@
+package hzip
+
+import "io/ioutil"
+
+// Histogram counts the symbols the encoder produces before Huffman coding:
+// literal bytes, the end-of-block code 256 and length codes 257 through 285
+// in Literal, and distance codes in Distance.
+type Histogram struct {
+	Literal  [286]int
+	Distance [30]int
+}
+
+// Analyze runs the match finder of the given compression level over p, split
+// into blocks as a Writer would split it, and returns the symbol histogram
+// without encoding anything. NoCompression writes only stored blocks, which
+// hold no symbols, so its histogram is empty.
+func Analyze(p []byte, level int) (*Histogram, error) {
+	z, err := NewWriterLevel(ioutil.Discard, level)
+	if err != nil {
+		return nil, err
+	}
+	h := new(Histogram)
+	if z.m == nil {
+		return h, nil
+	}
+	for {
+		block := p
+		if len(block) >= maxStoredBlockSize {
+			block = block[:maxStoredBlockSize]
+		}
+		p = p[len(block):]
+		z.tokens = z.m.tokenize(block, z.tokens[:0])
+		lit, dist := tokenFreqs(z.tokens)
+		for i, n := range lit {
+			h.Literal[i] += n
+		}
+		for i, n := range dist {
+			h.Distance[i] += n
+		}
+		// the remainder, even when empty, is the final block
+		if len(block) < maxStoredBlockSize {
+			return h, nil
+		}
+	}
+}
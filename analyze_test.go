@@ -0,0 +1,64 @@
+package hzip
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestAnalyze(t *testing.T) {
+	h, err := Analyze([]byte("abcabcabc"), DefaultCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a, b and c, then one match of length 6 (code 260) at distance 3
+	// (code 2), and the end of the block
+	var want Histogram
+	want.Literal['a'], want.Literal['b'], want.Literal['c'] = 1, 1, 1
+	want.Literal[260] = 1
+	want.Literal[256] = 1
+	want.Distance[2] = 1
+	if *h != want {
+		t.Errorf("histogram %v, want %v", nonzero(h), nonzero(&want))
+	}
+
+	h, err = Analyze([]byte("abcabcabc"), NoCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *h != (Histogram{}) {
+		t.Errorf("NoCompression histogram %v, want empty", nonzero(h))
+	}
+
+	// two full blocks and the empty final block each end with code 256
+	data := bytes.Repeat([]byte{'x'}, 2*maxStoredBlockSize)
+	if h, err = Analyze(data, BestSpeed); err != nil {
+		t.Fatal(err)
+	}
+	if h.Literal[256] != 3 {
+		t.Errorf("%d end-of-block codes for two full blocks, want 3", h.Literal[256])
+	}
+	if h.Literal['x'] < 1 || h.Distance[0] < 1 {
+		t.Errorf("run of x: histogram %v", nonzero(h))
+	}
+
+	if _, err := Analyze(nil, 10); err == nil {
+		t.Error("level 10 accepted")
+	}
+}
+
+// nonzero returns the symbols of h that occur, for error messages.
+func nonzero(h *Histogram) map[string]int {
+	m := make(map[string]int)
+	for i, n := range h.Literal {
+		if n > 0 {
+			m[fmt.Sprint("lit ", i)] = n
+		}
+	}
+	for i, n := range h.Distance {
+		if n > 0 {
+			m[fmt.Sprint("dist ", i)] = n
+		}
+	}
+	return m
+}
@@ -0,0 +1,84 @@
+package hzip
+
+import (
+	"hash/adler32"
+	"hash/crc32"
+)
+
+// CRC32 returns the CRC-32 of data using the IEEE polynomial, the checksum
+// stored in the gzip trailer.
+func CRC32(data []byte) uint32 {
+	return crc32.ChecksumIEEE(data)
+}
+
+// UpdateCRC32 returns the CRC-32 of the data checksummed by crc followed by p,
+// so that a checksum can be computed as data is produced.
+func UpdateCRC32(crc uint32, p []byte) uint32 {
+	return crc32.Update(crc, crc32.IEEETable, p)
+}
+
+// Adler32 returns the Adler-32 checksum of data, the checksum stored in the
+// zlib trailer.
+func Adler32(data []byte) uint32 {
+	return adler32.Checksum(data)
+}
+
+// crc32Combine returns the CRC-32 of the concatenation of two pieces of data,
+// given the CRC-32 of each and the length of the second. It appends len2 zero
+// bits to crc1 by repeated squaring of the GF(2) matrix that shifts a CRC by
+// one zero bit, as zlib's crc32_combine does.
+func crc32Combine(crc1, crc2 uint32, len2 int64) uint32 {
+	if len2 <= 0 {
+		return crc1
+	}
+	var even, odd [32]uint32
+
+	// odd shifts by one zero bit
+	odd[0] = crc32.IEEE
+	row := uint32(1)
+	for n := 1; n < 32; n++ {
+		odd[n] = row
+		row <<= 1
+	}
+	gf2MatrixSquare(even[:], odd[:]) // two zero bits
+	gf2MatrixSquare(odd[:], even[:]) // four zero bits
+
+	// each round squares the matrix once more and applies it for every set
+	// bit of len2, starting with one zero byte
+	for {
+		gf2MatrixSquare(even[:], odd[:])
+		if len2&1 != 0 {
+			crc1 = gf2MatrixTimes(even[:], crc1)
+		}
+		len2 >>= 1
+		if len2 == 0 {
+			break
+		}
+		gf2MatrixSquare(odd[:], even[:])
+		if len2&1 != 0 {
+			crc1 = gf2MatrixTimes(odd[:], crc1)
+		}
+		len2 >>= 1
+		if len2 == 0 {
+			break
+		}
+	}
+	return crc1 ^ crc2
+}
+
+func gf2MatrixTimes(mat []uint32, vec uint32) uint32 {
+	var sum uint32
+	for i := 0; vec != 0; i++ {
+		if vec&1 != 0 {
+			sum ^= mat[i]
+		}
+		vec >>= 1
+	}
+	return sum
+}
+
+func gf2MatrixSquare(square, mat []uint32) {
+	for n := range mat {
+		square[n] = gf2MatrixTimes(mat, mat[n])
+	}
+}
@@ -0,0 +1,69 @@
+package hzip
+
+import (
+	"bytes"
+	"hash/adler32"
+	"hash/crc32"
+	"testing"
+)
+
+var checksumInputs = [][]byte{
+	nil,
+	[]byte("a"),
+	[]byte("The quick brown fox jumps over the lazy dog"),
+	bytes.Repeat([]byte{0xff}, 100000),
+}
+
+func TestCRC32(t *testing.T) {
+	// the check value of CRC-32/IEEE
+	if got := CRC32([]byte("123456789")); got != 0xcbf43926 {
+		t.Errorf("CRC32(123456789) = %08x, want cbf43926", got)
+	}
+	for _, in := range checksumInputs {
+		want := crc32.ChecksumIEEE(in)
+		if got := CRC32(in); got != want {
+			t.Errorf("CRC32 of %d bytes = %08x, want %08x", len(in), got, want)
+		}
+		var crc uint32
+		for i := 0; i < len(in); i += 7 {
+			end := i + 7
+			if end > len(in) {
+				end = len(in)
+			}
+			crc = UpdateCRC32(crc, in[i:end])
+		}
+		if crc != want {
+			t.Errorf("UpdateCRC32 of %d bytes = %08x, want %08x", len(in), crc, want)
+		}
+	}
+}
+
+func TestAdler32(t *testing.T) {
+	if got := Adler32([]byte("Wikipedia")); got != 0x11e60398 {
+		t.Errorf("Adler32(Wikipedia) = %08x, want 11e60398", got)
+	}
+	for _, in := range checksumInputs {
+		if got, want := Adler32(in), adler32.Checksum(in); got != want {
+			t.Errorf("Adler32 of %d bytes = %08x, want %08x", len(in), got, want)
+		}
+	}
+}
+
+func TestCRC32Combine(t *testing.T) {
+	data := fixture(t, "rfc1952.txt")
+	want := CRC32(data)
+	for _, split := range []int{0, 1, 7, 1000, len(data) - 1, len(data)} {
+		a, b := data[:split], data[split:]
+		if got := crc32Combine(CRC32(a), CRC32(b), int64(len(b))); got != want {
+			t.Errorf("split at %d: crc32Combine = %08x, want %08x", split, got, want)
+		}
+	}
+
+	// three pieces combine left to right like one sequential CRC
+	x, y, z := checksumInputs[1], checksumInputs[2], checksumInputs[3]
+	all := append(append(append([]byte(nil), x...), y...), z...)
+	got := crc32Combine(crc32Combine(CRC32(x), CRC32(y), int64(len(y))), CRC32(z), int64(len(z)))
+	if want := crc32.ChecksumIEEE(all); got != want {
+		t.Errorf("three pieces: crc32Combine = %08x, want %08x", got, want)
+	}
+}
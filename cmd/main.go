@@ -1,26 +1,190 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"os"
+	"text/tabwriter"
+	"time"
 
 	"github.com/husainaloos/hzip"
 )
 
+// bufferSize is the read buffer size for compressed input.
+const bufferSize = 64 << 10
+
 func main() {
-	f, err := os.Open("../test/rfc1952.txt.gz")
+	log.SetFlags(0)
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s [file ...]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	listMode := flag.Bool("l", false, "list the header metadata of each member")
+	testMode := flag.Bool("t", false, "test the integrity of each input without writing output")
+	flag.Parse()
+
+	if *listMode {
+		listAll()
+		return
+	}
+	if *testMode {
+		if !testAll(os.Stdout, flag.Args()) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	if flag.NArg() == 0 {
+		if err := decompress(out, os.Stdin); err != nil {
+			out.Flush()
+			log.Fatalf("stdin: %v", err)
+		}
+	}
+	for _, name := range flag.Args() {
+		if err := decompressFile(out, name); err != nil {
+			out.Flush()
+			log.Fatalf("%s: %v", name, err)
+		}
+	}
+	if err := out.Flush(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func decompressFile(w io.Writer, name string) error {
+	f, err := os.Open(name)
 	if err != nil {
-		log.Fatalf("cannot read file: %v", err)
+		return err
 	}
 	defer f.Close()
-	rb, err := hzip.NewReaderBuilder(f)
+	return decompress(w, f)
+}
+
+// decompress writes the decoded contents of the gzip stream r to w.
+func decompress(w io.Writer, r io.Reader) error {
+	rb, err := hzip.NewReaderBuilder(r, hzip.WithBufferSize(bufferSize))
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	zr, err := rb.Reader()
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, zr)
+	return err
+}
+
+// testAll decodes every named input, or stdin when there are none, to verify
+// it, reporting one line per input to w. It reports whether all inputs are
+// valid.
+func testAll(w io.Writer, names []string) bool {
+	if len(names) == 0 {
+		return report(w, "stdin", decompress(ioutil.Discard, os.Stdin))
 	}
+	ok := true
+	for _, name := range names {
+		if !report(w, name, decompressFile(ioutil.Discard, name)) {
+			ok = false
+		}
+	}
+	return ok
+}
 
-	_, err = rb.Reader()
+func report(w io.Writer, name string, err error) bool {
 	if err != nil {
-		log.Fatal(err)
+		fmt.Fprintf(w, "%s: %v\n", name, err)
+		return false
+	}
+	fmt.Fprintf(w, "%s: OK\n", name)
+	return true
+}
+
+func listAll() {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "compressed\tuncompressed\tratio\tos\tmtime\tname\tcomment\t")
+	fail := func(name string, err error) {
+		tw.Flush()
+		log.Fatalf("%s: %v", name, err)
+	}
+	if flag.NArg() == 0 {
+		data, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			fail("stdin", err)
+		}
+		if err := list(tw, bytes.NewReader(data)); err != nil {
+			fail("stdin", err)
+		}
+	}
+	for _, name := range flag.Args() {
+		if err := listFile(tw, name); err != nil {
+			fail(name, err)
+		}
+	}
+	tw.Flush()
+}
+
+func listFile(w io.Writer, name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return list(w, f)
+}
+
+// file is a seekable input, such as an *os.File or a *bytes.Reader.
+type file interface {
+	io.ReadSeeker
+	io.ReaderAt
+}
+
+// list writes one line per gzip member of r. SkipMember finds where each
+// member ends, from the BGZF block size when the header has one and otherwise
+// by decoding the body, and the sizes are then read from the member's trailer.
+func list(w io.Writer, r file) error {
+	end, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
 	}
+	for off := int64(0); off < end; {
+		if _, err := r.Seek(off, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := hzip.SkipMember(r, hzip.WithBufferSize(bufferSize)); err != nil {
+			return err
+		}
+		next, err := r.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		csize := next - off
+		rb, err := hzip.NewReaderBuilder(io.NewSectionReader(r, off, csize), hzip.WithMultistream(false))
+		if err != nil {
+			return err
+		}
+		_, isize, err := rb.Trailer()
+		if err != nil {
+			return err
+		}
+		off = next
 
+		size := int64(isize)
+		ratio := 0.0
+		if size > 0 {
+			ratio = 100 * float64(size-csize) / float64(size)
+		}
+		mtime := "-"
+		if rb.HasModTime() {
+			mtime = rb.ModTime.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%d\t%d\t%.1f%%\t%s\t%s\t%s\t%s\t\n",
+			csize, size, ratio, rb.OSName(), mtime, rb.Name, rb.Comment)
+	}
+	return nil
 }
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/husainaloos/hzip"
+)
+
+func readFixture(t *testing.T, name string) []byte {
+	t.Helper()
+	b, err := ioutil.ReadFile("../test/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// listFields runs list over data and returns the tab-separated fields of
+// each line.
+func listFields(t *testing.T, data []byte) [][]string {
+	t.Helper()
+	var b bytes.Buffer
+	if err := list(&b, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	var lines [][]string
+	for _, line := range strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n") {
+		lines = append(lines, strings.Split(strings.TrimSuffix(line, "\t"), "\t"))
+	}
+	return lines
+}
+
+func TestListFixtures(t *testing.T) {
+	allflags, empty := readFixture(t, "allflags.gz"), readFixture(t, "empty.gz")
+	got := listFields(t, append(append([]byte{}, allflags...), empty...))
+	want := [][]string{
+		{"1483", "4000", "62.9%", "Unix", "2019-05-25T21:02:18Z", "rfc1952-head.txt", "all optional header fields set"},
+		{"26", "0", "0.0%", "Unix", "2026-10-14T18:29:37Z", "empty", ""},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d lines, want %d: %q", len(got), len(want), got)
+	}
+	for i := range want {
+		if strings.Join(got[i], "|") != strings.Join(want[i], "|") {
+			t.Errorf("line %d = %q, want %q", i, got[i], want[i])
+		}
+	}
+}
+
+func TestListBGZF(t *testing.T) {
+	var data bytes.Buffer
+	for _, body := range []string{"first block", "second, longer block"} {
+		var b bytes.Buffer
+		w := hzip.NewWriter(&b)
+		w.Extra = []byte{'B', 'C', 2, 0, 0, 0}
+		w.Write([]byte(body))
+		w.Close()
+		m := b.Bytes()
+		binary.LittleEndian.PutUint16(m[16:18], uint16(len(m)-1))
+		data.Write(m)
+	}
+	got := listFields(t, data.Bytes())
+	if len(got) != 2 || got[0][1] != "11" || got[1][1] != "20" {
+		t.Errorf("listing = %q", got)
+	}
+}
+
+func TestTestAll(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hunzip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	bad := readFixture(t, "rfc1952.txt.gz")
+	bad[len(bad)-8] ^= 0xff
+	badName := filepath.Join(dir, "bad.gz")
+	if err := ioutil.WriteFile(badName, bad, 0666); err != nil {
+		t.Fatal(err)
+	}
+	good := "../test/rfc1952.txt.gz"
+
+	var b bytes.Buffer
+	if !testAll(&b, []string{good}) {
+		t.Errorf("good file failed: %s", b.String())
+	}
+	if want := good + ": OK\n"; b.String() != want {
+		t.Errorf("good file reported %q, want %q", b.String(), want)
+	}
+
+	b.Reset()
+	if testAll(&b, []string{good, badName}) {
+		t.Error("corrupted file passed")
+	}
+	lines := strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n")
+	if len(lines) != 2 || lines[0] != good+": OK" {
+		t.Fatalf("reported %q", lines)
+	}
+	if !strings.HasPrefix(lines[1], badName+": ") || !strings.Contains(lines[1], "invalid checksum") {
+		t.Errorf("corrupted file reported %q, want a checksum error", lines[1])
+	}
+}
+
+// TestMain runs main instead of the tests when HUNZIP_RUN_MAIN is set, so
+// that the tests can run the command in a subprocess.
+func TestMain(m *testing.M) {
+	if os.Getenv("HUNZIP_RUN_MAIN") == "1" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// run runs the command with args and stdin, returning its stdout and stderr
+// and whether it exited with status 0.
+func run(t *testing.T, stdin []byte, args ...string) (stdout, stderr []byte, ok bool) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), "HUNZIP_RUN_MAIN=1")
+	cmd.Stdin = bytes.NewReader(stdin)
+	var o, e bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &o, &e
+	err := cmd.Run()
+	if _, exit := err.(*exec.ExitError); err != nil && !exit {
+		t.Fatal(err)
+	}
+	return o.Bytes(), e.Bytes(), err == nil
+}
+
+func TestDecompressCommand(t *testing.T) {
+	gz, text := readFixture(t, "rfc1952.txt.gz"), readFixture(t, "rfc1952.txt")
+
+	if out, errOut, ok := run(t, nil, "../test/rfc1952.txt.gz"); !ok || !bytes.Equal(out, text) {
+		t.Errorf("file: exit ok %t, %d bytes of %d, stderr %q", ok, len(out), len(text), errOut)
+	}
+	if out, errOut, ok := run(t, gz); !ok || !bytes.Equal(out, text) {
+		t.Errorf("stdin: exit ok %t, %d bytes of %d, stderr %q", ok, len(out), len(text), errOut)
+	}
+
+	bad := append([]byte(nil), gz...)
+	bad[len(bad)-8] ^= 0xff
+	out, errOut, ok := run(t, bad)
+	if ok {
+		t.Error("corrupted stdin exited with status 0")
+	}
+	if !bytes.HasPrefix(errOut, []byte("stdin: ")) {
+		t.Errorf("corrupted stdin: stderr %q", errOut)
+	}
+	// the output decoded before the checksum failed is still written
+	if !bytes.Equal(out, text) {
+		t.Errorf("corrupted stdin: wrote %d bytes, want %d", len(out), len(text))
+	}
+	if _, _, ok := run(t, nil, "../test/rfc1952.txt"); ok {
+		t.Error("file that is not gzip exited with status 0")
+	}
+}
@@ -0,0 +1,539 @@
+package hzip
+
+import (
+	"io"
+	"sort"
+	"sync"
+)
+
+// maxStoredBlockSize is the largest payload a stored block can carry.
+const maxStoredBlockSize = 0xffff
+
+// bitWriter writes the LSB-first bit stream of DEFLATE. Completed bytes are
+// collected in buf until flush writes them out; a partial byte stays in bits.
+type bitWriter struct {
+	w     io.Writer
+	bits  uint64
+	nbits uint
+	buf   []byte
+	n     int64 // bytes written to w
+	err   error
+}
+
+func newBitWriter(w io.Writer) *bitWriter {
+	return &bitWriter{w: w}
+}
+
+// writeBits writes the low n bits of b, n <= 32.
+func (bw *bitWriter) writeBits(b uint32, n uint) {
+	bw.bits |= uint64(b) << bw.nbits
+	bw.nbits += n
+	for bw.nbits >= 8 {
+		bw.buf = append(bw.buf, byte(bw.bits))
+		bw.bits >>= 8
+		bw.nbits -= 8
+	}
+}
+
+// align pads the current byte with zero bits.
+func (bw *bitWriter) align() {
+	if bw.nbits > 0 {
+		bw.writeBits(0, 8-bw.nbits)
+	}
+}
+
+// writeBytes writes whole bytes. The writer must be aligned.
+func (bw *bitWriter) writeBytes(p []byte) {
+	bw.buf = append(bw.buf, p...)
+}
+
+// flush writes the completed bytes to the underlying writer.
+func (bw *bitWriter) flush() error {
+	if bw.err != nil {
+		return bw.err
+	}
+	if len(bw.buf) > 0 {
+		var n int
+		n, bw.err = bw.w.Write(bw.buf)
+		bw.n += int64(n)
+		bw.buf = bw.buf[:0]
+	}
+	return bw.err
+}
+
+func writeBlockHeader(bw *bitWriter, bType uint32, final bool) {
+	var f uint32
+	if final {
+		f = 1
+	}
+	bw.writeBits(f, 1)
+	bw.writeBits(bType, 2)
+}
+
+// writeStoredBlock writes p, len(p) <= maxStoredBlockSize, as a stored block.
+func writeStoredBlock(bw *bitWriter, p []byte, final bool) {
+	writeBlockHeader(bw, 0, final)
+	bw.align()
+	var h [4]byte
+	le.PutUint16(h[0:2], uint16(len(p)))
+	le.PutUint16(h[2:4], ^uint16(len(p)))
+	bw.writeBytes(h[:])
+	bw.writeBytes(p)
+}
+
+// codeLengthOrder is the order in which the code lengths of the code-length
+// alphabet are stored in a dynamic block header.
+var codeLengthOrder = [19]int{16, 17, 18, 0, 8, 7, 9, 6, 10, 5, 11, 4, 12, 3, 13, 2, 14, 1, 15}
+
+// Base values and extra bit counts of the length codes 257..285 and the
+// distance codes 0..29, from RFC 1951 section 3.2.5.
+var (
+	lengthBase  = [29]int{3, 4, 5, 6, 7, 8, 9, 10, 11, 13, 15, 17, 19, 23, 27, 31, 35, 43, 51, 59, 67, 83, 99, 115, 131, 163, 195, 227, 258}
+	lengthExtra = [29]uint{0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 1, 1, 2, 2, 2, 2, 3, 3, 3, 3, 4, 4, 4, 4, 5, 5, 5, 5, 0}
+	distBase    = [30]int{1, 2, 3, 4, 5, 7, 9, 13, 17, 25, 33, 49, 65, 97, 129, 193, 257, 385, 513, 769, 1025, 1537, 2049, 3073, 4097, 6145, 8193, 12289, 16385, 24577}
+	distExtra   = [30]uint{0, 0, 0, 0, 1, 1, 2, 2, 3, 3, 4, 4, 5, 5, 6, 6, 7, 7, 8, 8, 9, 9, 10, 10, 11, 11, 12, 12, 13, 13}
+)
+
+// lengthCode returns the index into lengthBase of the code for a match
+// length of 3..258.
+func lengthCode(length int) int {
+	for c := len(lengthBase) - 1; ; c-- {
+		if lengthBase[c] <= length {
+			return c
+		}
+	}
+}
+
+// distCode returns the distance code of a distance of 1..32768.
+func distCode(dist int) int {
+	for c := len(distBase) - 1; ; c-- {
+		if distBase[c] <= dist {
+			return c
+		}
+	}
+}
+
+// token is an LZ77 symbol: either a literal byte, or a match of length
+// 3..258 at distance 1..32768 when matchFlag is set.
+type token uint32
+
+const matchFlag token = 1 << 31
+
+func literalToken(b byte) token {
+	return token(b)
+}
+
+func matchToken(length, dist int) token {
+	return matchFlag | token(length-3)<<15 | token(dist-1)
+}
+
+func (t token) isMatch() bool {
+	return t&matchFlag != 0
+}
+
+func (t token) literal() byte {
+	return byte(t)
+}
+
+func (t token) length() int {
+	return int(t&^matchFlag>>15) + 3
+}
+
+func (t token) dist() int {
+	return int(t&(1<<15-1)) + 1
+}
+
+// huffmanEncoder holds a canonical Huffman code. codes are stored with their
+// bits reversed so that they can be written LSB-first.
+type huffmanEncoder struct {
+	lengths []uint
+	codes   []uint32
+}
+
+// newHuffmanEncoder builds a complete Huffman code of at most maxBits bits
+// per code for the given symbol frequencies.
+func newHuffmanEncoder(freq []int, maxBits uint) *huffmanEncoder {
+	return newHuffmanEncoderLengths(huffmanLengths(freq, maxBits))
+}
+
+// newHuffmanEncoderLengths assigns the canonical codes for the given code
+// lengths.
+func newHuffmanEncoderLengths(lengths []uint) *huffmanEncoder {
+	var blcount [16]int
+	for _, l := range lengths {
+		blcount[l]++
+	}
+	blcount[0] = 0
+	var nextCode [16]int
+	code := 0
+	for b := 1; b < len(nextCode); b++ {
+		code = (code + blcount[b-1]) << 1
+		nextCode[b] = code
+	}
+	codes := make([]uint32, len(lengths))
+	for sym, l := range lengths {
+		if l > 0 {
+			codes[sym] = uint32(reverseBits(nextCode[l], l))
+			nextCode[l]++
+		}
+	}
+	return &huffmanEncoder{lengths: lengths, codes: codes}
+}
+
+func (e *huffmanEncoder) write(bw *bitWriter, sym int) {
+	bw.writeBits(e.codes[sym], e.lengths[sym])
+}
+
+// bits returns the number of bits needed to write the symbols counted in
+// freq.
+func (e *huffmanEncoder) bits(freq []int) int {
+	n := 0
+	for sym, f := range freq {
+		n += f * int(e.lengths[sym])
+	}
+	return n
+}
+
+var (
+	fixedOnceEnc sync.Once
+	fixedLitEnc  *huffmanEncoder
+	fixedDistEnc *huffmanEncoder
+)
+
+// fixedHuffmanEncoders returns the literal/length and distance codes of the
+// fixed Huffman code.
+func fixedHuffmanEncoders() (*huffmanEncoder, *huffmanEncoder) {
+	fixedOnceEnc.Do(func() {
+		lit := make([]uint, 288)
+		for i := range lit {
+			switch {
+			case i < 144:
+				lit[i] = 8
+			case i < 256:
+				lit[i] = 9
+			case i < 280:
+				lit[i] = 7
+			default:
+				lit[i] = 8
+			}
+		}
+		dist := make([]uint, 30)
+		for i := range dist {
+			dist[i] = 5
+		}
+		fixedLitEnc = newHuffmanEncoderLengths(lit)
+		fixedDistEnc = newHuffmanEncoderLengths(dist)
+	})
+	return fixedLitEnc, fixedDistEnc
+}
+
+// huffmanLengths computes Huffman code lengths for freq, limited to maxBits.
+// At least two symbols always get a code, so that the code is complete even
+// when fewer symbols are used.
+func huffmanLengths(freq []int, maxBits uint) []uint {
+	var syms []int
+	for s, f := range freq {
+		if f > 0 {
+			syms = append(syms, s)
+		}
+	}
+	for s := 0; len(syms) < 2; s++ {
+		if freq[s] == 0 {
+			syms = append(syms, s)
+		}
+	}
+	sort.Slice(syms, func(i, j int) bool {
+		fi, fj := freq[syms[i]], freq[syms[j]]
+		if fi != fj {
+			return fi < fj
+		}
+		return syms[i] < syms[j]
+	})
+
+	// Build the tree with the two-queue method: leaves are taken in order of
+	// increasing weight, and internal nodes are created in that order too.
+	n := len(syms)
+	weight := make([]int, n, 2*n-1)
+	parent := make([]int, 2*n-1)
+	for i, s := range syms {
+		weight[i] = freq[s]
+	}
+	leaf, inner := 0, n
+	pick := func() int {
+		if leaf < n && (inner == len(weight) || weight[leaf] <= weight[inner]) {
+			leaf++
+			return leaf - 1
+		}
+		inner++
+		return inner - 1
+	}
+	for len(weight) < 2*n-1 {
+		a, b := pick(), pick()
+		parent[a] = len(weight)
+		parent[b] = len(weight)
+		weight = append(weight, weight[a]+weight[b])
+	}
+	depth := make([]uint, 2*n-1)
+	for i := 2*n - 3; i >= 0; i-- {
+		depth[i] = depth[parent[i]] + 1
+	}
+
+	lengths := make([]uint, len(freq))
+	for i, s := range syms {
+		lengths[s] = depth[i]
+	}
+	limitLengths(lengths, syms, maxBits)
+	return lengths
+}
+
+// limitLengths shortens codes longer than maxBits and then rebalances the
+// other lengths so that the code stays complete. syms lists the coded
+// symbols in order of increasing frequency.
+func limitLengths(lengths []uint, syms []int, maxBits uint) {
+	over := false
+	for _, s := range syms {
+		if lengths[s] > maxBits {
+			lengths[s] = maxBits
+			over = true
+		}
+	}
+	if !over {
+		return
+	}
+
+	// kraft is the code space used, in units of codes of maxBits bits
+	total := 1 << maxBits
+	kraft := 0
+	for _, s := range syms {
+		kraft += 1 << (maxBits - lengths[s])
+	}
+	for kraft > total {
+		// lengthen the longest code that can still grow, which frees the
+		// least code space and so disturbs the code the least
+		best := -1
+		for _, s := range syms {
+			if lengths[s] < maxBits && (best < 0 || lengths[s] > lengths[best]) {
+				best = s
+			}
+		}
+		kraft -= 1 << (maxBits - lengths[best] - 1)
+		lengths[best]++
+	}
+	for i := len(syms) - 1; kraft < total; {
+		// give unused code space back to the most frequent symbols
+		s := syms[i]
+		if lengths[s] > 1 && kraft+(1<<(maxBits-lengths[s])) <= total {
+			kraft += 1 << (maxBits - lengths[s])
+			lengths[s]--
+			continue
+		}
+		i--
+		if i < 0 {
+			i = len(syms) - 1
+		}
+	}
+}
+
+// rleCodeLengths encodes code lengths with the run-length symbols 16, 17 and
+// 18 of the code-length alphabet. Each entry holds the symbol in its low
+// byte and the value of its extra bits above it.
+func rleCodeLengths(lengths []uint) []int {
+	var out []int
+	for i := 0; i < len(lengths); {
+		l := lengths[i]
+		run := 1
+		for i+run < len(lengths) && lengths[i+run] == l {
+			run++
+		}
+		i += run
+
+		if l == 0 {
+			for run >= 11 {
+				n := run
+				if n > 138 {
+					n = 138
+				}
+				out = append(out, 18|(n-11)<<8)
+				run -= n
+			}
+			if run >= 3 {
+				out = append(out, 17|(run-3)<<8)
+				run = 0
+			}
+		} else {
+			out = append(out, int(l))
+			run--
+			for run >= 3 {
+				n := run
+				if n > 6 {
+					n = 6
+				}
+				out = append(out, 16|(n-3)<<8)
+				run -= n
+			}
+		}
+		for ; run > 0; run-- {
+			out = append(out, int(l))
+		}
+	}
+	return out
+}
+
+// tokenFreqs counts the literal/length and distance symbols of tokens,
+// including the end-of-block code.
+func tokenFreqs(tokens []token) (lit [286]int, dist [30]int) {
+	for _, t := range tokens {
+		if t.isMatch() {
+			lit[257+lengthCode(t.length())]++
+			dist[distCode(t.dist())]++
+		} else {
+			lit[t.literal()]++
+		}
+	}
+	lit[256]++
+	return lit, dist
+}
+
+// extraBits returns the number of extra bits written after the length and
+// distance codes counted in the frequencies.
+func extraBits(litFreq, distFreq []int) int {
+	n := 0
+	for c, e := range lengthExtra {
+		n += litFreq[257+c] * int(e)
+	}
+	for c, e := range distExtra {
+		n += distFreq[c] * int(e)
+	}
+	return n
+}
+
+// dynamicHeader holds the codes of a dynamic block and the description of
+// their code lengths that starts the block.
+type dynamicHeader struct {
+	lit, dist, cl *huffmanEncoder
+	nlit, ndist   int
+	nclen         int
+	rle           []int
+}
+
+func newDynamicHeader(litFreq, distFreq []int) *dynamicHeader {
+	h := &dynamicHeader{
+		lit:  newHuffmanEncoder(litFreq, 15),
+		dist: newHuffmanEncoder(distFreq, 15),
+	}
+	h.nlit = len(h.lit.lengths)
+	for h.nlit > 257 && h.lit.lengths[h.nlit-1] == 0 {
+		h.nlit--
+	}
+	h.ndist = len(h.dist.lengths)
+	for h.ndist > 1 && h.dist.lengths[h.ndist-1] == 0 {
+		h.ndist--
+	}
+	lengths := make([]uint, 0, h.nlit+h.ndist)
+	lengths = append(lengths, h.lit.lengths[:h.nlit]...)
+	lengths = append(lengths, h.dist.lengths[:h.ndist]...)
+
+	h.rle = rleCodeLengths(lengths)
+	var clFreq [19]int
+	for _, c := range h.rle {
+		clFreq[c&0xff]++
+	}
+	h.cl = newHuffmanEncoder(clFreq[:], 7)
+	h.nclen = len(codeLengthOrder)
+	for h.nclen > 4 && h.cl.lengths[codeLengthOrder[h.nclen-1]] == 0 {
+		h.nclen--
+	}
+	return h
+}
+
+// bits returns the size of the header, after the 3 bits of the block type.
+func (h *dynamicHeader) bits() int {
+	n := 5 + 5 + 4 + 3*h.nclen
+	for _, c := range h.rle {
+		sym := c & 0xff
+		n += int(h.cl.lengths[sym])
+		switch sym {
+		case 16:
+			n += 2
+		case 17:
+			n += 3
+		case 18:
+			n += 7
+		}
+	}
+	return n
+}
+
+func (h *dynamicHeader) write(bw *bitWriter, final bool) {
+	writeBlockHeader(bw, 2, final)
+	bw.writeBits(uint32(h.nlit-257), 5)
+	bw.writeBits(uint32(h.ndist-1), 5)
+	bw.writeBits(uint32(h.nclen-4), 4)
+	for _, s := range codeLengthOrder[:h.nclen] {
+		bw.writeBits(uint32(h.cl.lengths[s]), 3)
+	}
+	for _, c := range h.rle {
+		sym := c & 0xff
+		h.cl.write(bw, sym)
+		switch sym {
+		case 16:
+			bw.writeBits(uint32(c>>8), 2)
+		case 17:
+			bw.writeBits(uint32(c>>8), 3)
+		case 18:
+			bw.writeBits(uint32(c>>8), 7)
+		}
+	}
+}
+
+// writeFixedBlock writes tokens as a block compressed with the fixed Huffman
+// code.
+func writeFixedBlock(bw *bitWriter, tokens []token, final bool) {
+	lit, dist := fixedHuffmanEncoders()
+	writeBlockHeader(bw, 1, final)
+	writeTokens(bw, tokens, lit, dist)
+}
+
+// writeCompressedBlock writes raw, which tokens encode, as whichever of a
+// stored, fixed or dynamic block is smallest.
+func writeCompressedBlock(bw *bitWriter, raw []byte, tokens []token, final bool) {
+	litFreq, distFreq := tokenFreqs(tokens)
+	extra := extraBits(litFreq[:], distFreq[:])
+
+	h := newDynamicHeader(litFreq[:], distFreq[:])
+	dynamic := h.bits() + h.lit.bits(litFreq[:]) + h.dist.bits(distFreq[:]) + extra
+	fixedLit, fixedDist := fixedHuffmanEncoders()
+	fixed := fixedLit.bits(litFreq[:]) + fixedDist.bits(distFreq[:]) + extra
+	// a stored block is padded to a byte boundary after its 3 header bits
+	stored := (8-(int(bw.nbits)+3)%8)%8 + 32 + 8*len(raw)
+
+	switch {
+	case stored <= fixed && stored <= dynamic:
+		writeStoredBlock(bw, raw, final)
+	case fixed <= dynamic:
+		writeFixedBlock(bw, tokens, final)
+	default:
+		h.write(bw, final)
+		writeTokens(bw, tokens, h.lit, h.dist)
+	}
+}
+
+// writeTokens writes the tokens of a compressed block and its end-of-block
+// code.
+func writeTokens(bw *bitWriter, tokens []token, lit, dist *huffmanEncoder) {
+	for _, t := range tokens {
+		if !t.isMatch() {
+			lit.write(bw, int(t.literal()))
+			continue
+		}
+		length := t.length()
+		lc := lengthCode(length)
+		lit.write(bw, 257+lc)
+		bw.writeBits(uint32(length-lengthBase[lc]), lengthExtra[lc])
+		d := t.dist()
+		dc := distCode(d)
+		dist.write(bw, dc)
+		bw.writeBits(uint32(d-distBase[dc]), distExtra[dc])
+	}
+	lit.write(bw, 256)
+}
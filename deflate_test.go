@@ -0,0 +1,40 @@
+package hzip
+
+import "testing"
+
+func TestHuffmanLengths(t *testing.T) {
+	// Fibonacci frequencies give the deepest possible tree, one level per
+	// symbol, before lengths are limited
+	fib := make([]int, 30)
+	fib[0], fib[1] = 1, 1
+	for i := 2; i < len(fib); i++ {
+		fib[i] = fib[i-1] + fib[i-2]
+	}
+	tests := []struct {
+		name    string
+		freq    []int
+		maxBits uint
+	}{
+		{"fibonacci", fib, 15},
+		{"fibonacci, 7 bits", fib[:19], 7},
+		{"uniform", []int{5, 5, 5, 5, 5, 5, 5, 5}, 15},
+		{"one symbol", []int{0, 0, 9, 0}, 15},
+		{"no symbols", []int{0, 0, 0}, 15},
+	}
+	for _, tt := range tests {
+		lengths := huffmanLengths(tt.freq, tt.maxBits)
+		var used []uint
+		for s, l := range lengths {
+			if l > tt.maxBits {
+				t.Errorf("%s: symbol %d has %d bits, limit %d", tt.name, s, l, tt.maxBits)
+			}
+			if tt.freq[s] > 0 && l == 0 {
+				t.Errorf("%s: symbol %d has no code", tt.name, s)
+			}
+			used = append(used, l)
+		}
+		if err := checkCodeLengths(used); err != nil {
+			t.Errorf("%s: lengths %v are not a complete code", tt.name, lengths)
+		}
+	}
+}
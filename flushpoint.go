@@ -0,0 +1,56 @@
+package hzip
+
+import "io"
+
+// FlushPoint is a place in a gzip stream from which decoding can start
+// without the data before it: In is the offset in the uncompressed data and
+// Out the offset in the compressed stream, counted from the first byte the
+// Writer wrote.
+type FlushPoint struct {
+	In, Out int64
+}
+
+// WithFlushInterval makes the Writer end a block with a full flush after
+// every n bytes of input. A full flush is an empty stored block after which
+// no match refers back, so each flush point starts a byte-aligned region that
+// decodes on its own. The points are returned by FlushPoints.
+func WithFlushInterval(n int) WriterOption {
+	return func(z *Writer) {
+		z.flushInterval = n
+	}
+}
+
+// FlushPoints returns the flush points written so far.
+func (z *Writer) FlushPoints() []FlushPoint {
+	return z.points
+}
+
+// fullFlush writes out the buffered data and an empty stored block, forgets
+// the window and records a flush point.
+func (z *Writer) fullFlush() error {
+	if len(z.buf) > 0 {
+		if err := z.writeBlock(false); err != nil {
+			return err
+		}
+	}
+	writeStoredBlock(z.bw, nil, false)
+	if err := z.bw.flush(); err != nil {
+		return err
+	}
+	if z.m != nil {
+		z.m.reset()
+	}
+	z.pending = 0
+	z.points = append(z.points, FlushPoint{In: z.in, Out: z.bw.n})
+	return nil
+}
+
+// NewFlushPointReader seeks r, the stream written by a Writer, to the flush
+// point p and returns a reader of the uncompressed data from p.In to the end
+// of the member. It is a raw DEFLATE reader, so the trailer is not checked.
+func NewFlushPointReader(r io.ReadSeeker, p FlushPoint, opts ...Option) (io.Reader, error) {
+	if _, err := r.Seek(p.Out, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return NewDeflateReader(r, opts...)
+}
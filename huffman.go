@@ -0,0 +1,199 @@
+package hzip
+
+const (
+	huffmanRootBits = 9
+	huffmanRootSize = 1 << huffmanRootBits
+	huffmanRootMask = huffmanRootSize - 1
+
+	// huffmanLink marks a root entry whose value is the index of the
+	// subtable that resolves codes longer than huffmanRootBits.
+	huffmanLink = 1 << 31
+)
+
+// huffmanDecoder is a canonical Huffman decoding table. Codes of up to
+// huffmanRootBits bits resolve with a single lookup in root; longer codes
+// continue into one of links, indexed by the remaining bits.
+//
+// Entries hold the symbol in bits 8..30 and the code length in bits 0..7. A
+// zero entry marks bits that no code starts with.
+type huffmanDecoder struct {
+	max      uint
+	root     [huffmanRootSize]uint32
+	links    [][]uint32
+	linkMask uint32
+}
+
+// checkCodeLengths reports whether the code lengths form a complete canonical
+// Huffman code, that is one that neither over-subscribes nor leaves unused
+// parts of the code space.
+func checkCodeLengths(lengths []uint) error {
+	var count [16]int
+	for _, l := range lengths {
+		if l >= uint(len(count)) {
+			return ErrBadHuffman
+		}
+		count[l]++
+	}
+	left := 1
+	for l := 1; l < len(count); l++ {
+		left = left<<1 - count[l]
+		if left < 0 {
+			return ErrBadHuffman
+		}
+	}
+	if left > 0 {
+		return ErrBadHuffman
+	}
+	return nil
+}
+
+// newHuffmanDecoder builds a decoder from the per-symbol code lengths, the
+// same input buildHuffmanTree takes.
+func newHuffmanDecoder(lengths []uint) (*huffmanDecoder, error) {
+	h := new(huffmanDecoder)
+	if err := h.init(lengths); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// init rebuilds h in place from the code lengths of a complete code, reusing
+// its subtables.
+func (h *huffmanDecoder) init(lengths []uint) error {
+	if err := checkCodeLengths(lengths); err != nil {
+		return err
+	}
+	h.build(lengths)
+	return nil
+}
+
+// initDistance is like init for a distance code. Besides complete codes,
+// RFC 1951 section 3.2.7 allows a single distance code of one bit, and blocks
+// without any matches may leave every distance length zero; decoding a
+// distance with such an empty code fails.
+func (h *huffmanDecoder) initDistance(lengths []uint) error {
+	used := 0
+	var length uint
+	for _, l := range lengths {
+		if l > 0 {
+			used++
+			length = l
+		}
+	}
+	if used > 1 || (used == 1 && length != 1) {
+		if err := checkCodeLengths(lengths); err != nil {
+			return err
+		}
+	}
+	h.build(lengths)
+	return nil
+}
+
+// build fills h from lengths, which must not exceed maxCodeLength. It
+// allocates only when a subtable larger than any before is needed.
+func (h *huffmanDecoder) build(lengths []uint) {
+	h.max = 0
+	h.root = [huffmanRootSize]uint32{}
+	h.links = h.links[:0]
+	h.linkMask = 0
+	for _, l := range lengths {
+		if l > h.max {
+			h.max = l
+		}
+	}
+
+	var blcount, nextCode [maxCodeLength + 1]int
+	for _, l := range lengths {
+		blcount[l]++
+	}
+	blcount[0] = 0
+	code := 0
+	for b := uint(1); b <= h.max; b++ {
+		code = (code + blcount[b-1]) << 1
+		nextCode[b] = code
+	}
+
+	var linkBits uint
+	if h.max > huffmanRootBits {
+		linkBits = h.max - huffmanRootBits
+		h.linkMask = 1<<linkBits - 1
+	}
+
+	for sym, l := range lengths {
+		if l == 0 {
+			continue
+		}
+		code := nextCode[l]
+		nextCode[l]++
+
+		// codes are packed starting from their most significant bit, so
+		// the table is indexed by the reversed code
+		rev := uint32(reverseBits(code, l))
+		entry := uint32(sym)<<8 | uint32(l)
+		if l <= huffmanRootBits {
+			for i := rev; i < huffmanRootSize; i += 1 << l {
+				h.root[i] = entry
+			}
+			continue
+		}
+
+		r := h.root[rev&huffmanRootMask]
+		if r&huffmanLink == 0 {
+			r = huffmanLink | uint32(len(h.links))<<8
+			h.root[rev&huffmanRootMask] = r
+			h.addLink(1 << linkBits)
+		}
+		link := h.links[(r&^huffmanLink)>>8]
+		for i := rev >> huffmanRootBits; i < uint32(len(link)); i += 1 << (l - huffmanRootBits) {
+			link[i] = entry
+		}
+	}
+}
+
+// addLink appends a cleared subtable of n entries, reusing one left over from
+// an earlier build when it is large enough.
+func (h *huffmanDecoder) addLink(n int) {
+	i := len(h.links)
+	if i < cap(h.links) {
+		if t := h.links[:i+1][i]; cap(t) >= n {
+			t = t[:n]
+			for j := range t {
+				t[j] = 0
+			}
+			h.links = append(h.links, t)
+			return
+		}
+	}
+	h.links = append(h.links, make([]uint32, n))
+}
+
+// decode reads one code from br and returns its symbol.
+func (h *huffmanDecoder) decode(br *bitReader) (int, error) {
+	// near the end of the input there may be fewer than max bits left, which
+	// is fine as long as the code itself fits in what was read
+	ferr := br.fill(h.max)
+
+	e := h.root[br.bits&huffmanRootMask]
+	if e&huffmanLink != 0 {
+		e = h.links[(e&^huffmanLink)>>8][(br.bits>>huffmanRootBits)&h.linkMask]
+	}
+	n := uint(e & 0xff)
+	if n == 0 || n > br.nbits {
+		if ferr != nil {
+			return 0, ferr
+		}
+		return 0, ErrBadCode
+	}
+	br.bits >>= n
+	br.nbits -= n
+	return int(e >> 8), nil
+}
+
+func reverseBits(code int, n uint) int {
+	r := 0
+	for i := uint(0); i < n; i++ {
+		r = r<<1 | code&1
+		code >>= 1
+	}
+	return r
+}
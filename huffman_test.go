@@ -0,0 +1,461 @@
+package hzip
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+)
+
+// skewedLengths is a complete code with lengths 1 through 15, so that its
+// decoder needs subtables.
+var skewedLengths = []uint{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 15}
+
+func TestHuffmanDecoderRebuild(t *testing.T) {
+	want, err := newHuffmanDecoder(skewedLengths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// rebuilding a decoder that held other codes must give the same tables
+	var h huffmanDecoder
+	for _, lengths := range [][]uint{skewedLengths, {1, 1}, {2, 2, 2, 2}, skewedLengths} {
+		if err := h.init(lengths); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if h.max != want.max || h.root != want.root || len(h.links) != len(want.links) {
+		t.Fatalf("rebuilt decoder differs: max %d/%d, %d/%d links", h.max, want.max, len(h.links), len(want.links))
+	}
+	for i := range h.links {
+		for j := range h.links[i] {
+			if h.links[i][j] != want.links[i][j] {
+				t.Fatalf("link %d entry %d = %x, want %x", i, j, h.links[i][j], want.links[i][j])
+			}
+		}
+	}
+}
+
+func BenchmarkBuildHuffmanTree(b *testing.B) {
+	b.ReportAllocs()
+	var nodes []HuffmanTree
+	for i := 0; i < b.N; i++ {
+		_, nodes = buildHuffmanTree(skewedLengths, nodes)
+	}
+}
+
+func BenchmarkNewHuffmanDecoder(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := newHuffmanDecoder(skewedLengths); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkHuffmanDecoderInit(b *testing.B) {
+	b.ReportAllocs()
+	var h huffmanDecoder
+	for i := 0; i < b.N; i++ {
+		if err := h.init(skewedLengths); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkDynamicBlocks decodes a stream of many small dynamic blocks, whose
+// cost is dominated by building their codes.
+func BenchmarkDynamicBlocks(b *testing.B) {
+	var src bytes.Buffer
+	w := NewWriter(&src)
+	text := fixture(b, "rfc1952.txt")
+	for off := 0; off+1000 <= len(text); off += 1000 {
+		w.Write(text[off : off+1000])
+		w.Flush()
+	}
+	w.Close()
+	data := src.Bytes()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := decodeAll(data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestCheckCodeLengths(t *testing.T) {
+	tests := []struct {
+		name    string
+		lengths []uint
+		ok      bool
+	}{
+		{"one bit", []uint{1, 1}, true},
+		{"skewed", skewedLengths, true},
+		{"with unused", []uint{2, 0, 1, 2, 0}, true},
+		{"over-subscribed", []uint{1, 1, 1}, false},
+		{"over-subscribed deep", []uint{1, 2, 3, 3, 15}, false},
+		{"incomplete", []uint{1, 2}, false},
+		{"single code", []uint{0, 1}, false},
+		{"empty", []uint{0, 0, 0}, false},
+		{"too long", []uint{1, 16}, false},
+	}
+	for _, tt := range tests {
+		err := checkCodeLengths(tt.lengths)
+		if (err == nil) != tt.ok || err != nil && err != ErrBadHuffman {
+			t.Errorf("%s: checkCodeLengths = %v, want ok %t", tt.name, err, tt.ok)
+		}
+		if _, err := newHuffmanDecoder(tt.lengths); (err == nil) != tt.ok {
+			t.Errorf("%s: newHuffmanDecoder error %v, want ok %t", tt.name, err, tt.ok)
+		}
+	}
+}
+
+// dynamicBlock writes a final dynamic block with the given literal/length and
+// distance code lengths, which need not form valid codes.
+func dynamicBlock(lit, dist []uint, tokens []token) []byte {
+	h := lengthsHeader(lit, dist)
+	var b bytes.Buffer
+	bw := newBitWriter(&b)
+	h.write(bw, true)
+	writeTokens(bw, tokens, h.lit, h.dist)
+	bw.align()
+	bw.flush()
+	return b.Bytes()
+}
+
+// lengthsHeader returns the header of a dynamic block with the given code
+// lengths, sending all 19 code length code lengths.
+func lengthsHeader(lit, dist []uint) *dynamicHeader {
+	h := &dynamicHeader{
+		lit:   newHuffmanEncoderLengths(lit),
+		dist:  newHuffmanEncoderLengths(dist),
+		nlit:  len(lit),
+		ndist: len(dist),
+		nclen: len(codeLengthOrder),
+	}
+	h.rle = rleCodeLengths(append(append([]uint(nil), lit...), dist...))
+	var clFreq [19]int
+	for _, c := range h.rle {
+		clFreq[c&0xff]++
+	}
+	h.cl = newHuffmanEncoder(clFreq[:], 7)
+	return h
+}
+
+// literalLengths returns complete literal/length code lengths for all 286
+// symbols: 8 bits for 0 through 225 and 9 bits for the rest.
+func literalLengths() []uint {
+	lit := make([]uint, 286)
+	for i := range lit {
+		lit[i] = 8
+		if i >= 226 {
+			lit[i] = 9
+		}
+	}
+	return lit
+}
+
+func TestBadDynamicCodes(t *testing.T) {
+	over, short := literalLengths(), literalLengths()
+	over[285] = 8
+	short[0] = 9
+	tests := []struct {
+		name      string
+		lit, dist []uint
+	}{
+		{"literals over-subscribed", over, []uint{1, 1}},
+		{"literals incomplete", short, []uint{1, 1}},
+		{"distances over-subscribed", literalLengths(), []uint{1, 1, 1}},
+		{"distances incomplete", literalLengths(), []uint{1, 2, 0}},
+	}
+	for _, tt := range tests {
+		if _, err := inflateAll(dynamicBlock(tt.lit, tt.dist, nil)); !errors.Is(err, ErrBadHuffman) {
+			t.Errorf("%s: error %v, want ErrBadHuffman", tt.name, err)
+		}
+	}
+
+	// and a valid block with the same layout decodes
+	tokens := []token{literalToken('a'), literalToken('b')}
+	if got, err := inflateAll(dynamicBlock(literalLengths(), []uint{1, 1}, tokens)); err != nil || string(got) != "ab" {
+		t.Errorf("valid block: decoded %q, %v", got, err)
+	}
+}
+
+func TestDistanceCodeEdgeCases(t *testing.T) {
+	lits := func(s string) []token {
+		var t []token
+		for i := 0; i < len(s); i++ {
+			t = append(t, literalToken(s[i]))
+		}
+		return t
+	}
+	tests := []struct {
+		name   string
+		dist   []uint
+		tokens []token
+		want   string
+		err    error
+	}{
+		{"one code, HDIST 1", []uint{1}, append(lits("abc"), matchToken(3, 1)), "abcccc", nil},
+		{"one code of four", []uint{0, 0, 0, 1}, append(lits("ab"), matchToken(5, 4)), "", ErrBadDistance},
+		{"one code of four, in range", []uint{0, 0, 0, 1}, append(lits("abcd"), matchToken(4, 4)), "abcdabcd", nil},
+		{"no codes, no matches", []uint{0}, lits("abc"), "abc", nil},
+		{"no codes, all 30 lengths zero", make([]uint, 30), lits("abc"), "abc", nil},
+		{"no codes, a match", []uint{0}, append(lits("abc"), matchToken(3, 1)), "", ErrBadCode},
+	}
+	for _, tt := range tests {
+		got, err := inflateAll(dynamicBlock(literalLengths(), tt.dist, tt.tokens))
+		if !errors.Is(err, tt.err) || (err != nil) != (tt.err != nil) {
+			t.Errorf("%s: error %v, want %v", tt.name, err, tt.err)
+			continue
+		}
+		if err == nil && string(got) != tt.want {
+			t.Errorf("%s: decoded %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestTrailingZeroLengths(t *testing.T) {
+	// codes built without the last three length codes and without the
+	// distance codes past 9
+	litFreq, distFreq := make([]int, 286), make([]int, 30)
+	for i := 0; i < 283; i++ {
+		litFreq[i] = 1 + i%7
+	}
+	for i := 0; i < 10; i++ {
+		distFreq[i] = 1 + i
+	}
+	lit := newHuffmanEncoder(litFreq, 15).lengths
+	dist := newHuffmanEncoder(distFreq, 15).lengths
+	for _, l := range append(append([]uint(nil), lit[283:]...), dist[10:]...) {
+		if l != 0 {
+			t.Fatalf("unused symbols have lengths %v, %v", lit[283:], dist[10:])
+		}
+	}
+
+	var tokens []token
+	for _, c := range []byte("trailing zeros") {
+		tokens = append(tokens, literalToken(c))
+	}
+	for _, n := range []int{3, 20, 100, 194} {
+		tokens = append(tokens, matchToken(n, 14))
+	}
+	for i := 1; i <= 10; i++ {
+		tokens = append(tokens, matchToken(3, i))
+	}
+	want := replay(t, nil, tokens)
+
+	// HLIT 29 and HDIST 29 declare the zero-length tail; HLIT 26 and HDIST
+	// 9 leave it out, and both must decode the same
+	for _, n := range []struct{ nlit, ndist int }{{286, 30}, {283, 10}} {
+		got, err := inflateAll(dynamicBlock(lit[:n.nlit], dist[:n.ndist], tokens))
+		if err != nil || !bytes.Equal(got, want) {
+			t.Errorf("HLIT %d, HDIST %d: decoded %q, %v; want %q", n.nlit-257, n.ndist-1, got, err, want)
+		}
+	}
+
+	// and the codes of the used symbols do not depend on the tail
+	for _, c := range []struct {
+		name       string
+		full, trim []uint
+	}{{"literal/length", lit, lit[:283]}, {"distance", dist, dist[:10]}} {
+		full, err := newHuffmanDecoder(c.full)
+		if err != nil {
+			t.Fatal(err)
+		}
+		trim, err := newHuffmanDecoder(c.trim)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if full.max != trim.max || full.root != trim.root || len(full.links) != len(trim.links) {
+			t.Errorf("%s: decoder with trailing zeros differs", c.name)
+			continue
+		}
+		for i := range full.links {
+			if !equalEntries(full.links[i], trim.links[i]) {
+				t.Errorf("%s: subtable %d differs", c.name, i)
+			}
+		}
+	}
+}
+
+func equalEntries(a, b []uint32) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// pathReader returns a bit reader over the bits of path, a string of '0' and
+// '1' in the order they are read.
+func pathReader(t *testing.T, path string) *bitReader {
+	t.Helper()
+	var b bytes.Buffer
+	bw := newBitWriter(&b)
+	for _, c := range path {
+		bw.writeBits(uint32(c-'0'), 1)
+	}
+	bw.align()
+	bw.flush()
+	br, err := newBitReader(bytes.NewReader(b.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return br
+}
+
+func TestHuffmanTreeDecode(t *testing.T) {
+	// symbol 1 is 0, 0 is 10, 2 is 110 and 3 is 111; symbols 0 and 2 of the
+	// incomplete code are 0 and 10, leaving 11 unused
+	complete, _ := buildHuffmanTree([]uint{2, 1, 3, 3}, nil)
+	incomplete, _ := buildHuffmanTree([]uint{1, 0, 2}, nil)
+	tests := []struct {
+		tree *HuffmanTree
+		path string
+		want []int
+		err  error
+	}{
+		{complete, "0", []int{1}, nil},
+		{complete, "10", []int{0}, nil},
+		{complete, "110", []int{2}, nil},
+		{complete, "111", []int{3}, nil},
+		{complete, "111110100", []int{3, 2, 0, 1}, nil},
+		{incomplete, "0100", []int{0, 2, 0}, nil},
+		{incomplete, "11", nil, ErrBadCode},
+		{incomplete, "011", []int{0}, ErrBadCode},
+	}
+	for _, tt := range tests {
+		br := pathReader(t, tt.path)
+		var got []int
+		var err error
+		for len(got) < len(tt.want) || tt.err != nil && err == nil {
+			var sym int
+			if sym, err = tt.tree.decode(br); err != nil {
+				break
+			}
+			got = append(got, sym)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) || err != tt.err {
+			t.Errorf("path %s: decoded %v, %v; want %v, %v", tt.path, got, err, tt.want, tt.err)
+		}
+	}
+
+	// the input is one byte, eight codes for symbol 1; reading past them
+	// fails instead of returning a symbol
+	br := pathReader(t, "0")
+	for i := 0; i < 8; i++ {
+		if sym, err := complete.decode(br); sym != 1 || err != nil {
+			t.Fatalf("code %d: decoded %d, %v; want 1", i, sym, err)
+		}
+	}
+	if _, err := complete.decode(br); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("past the end: error %v, want io.ErrUnexpectedEOF", err)
+	}
+}
+
+// symbolStream returns the code lengths of a literal code fitted to the bytes
+// of rfc1952.txt, with every byte value present so that rare ones get codes
+// longer than huffmanRootBits, and those bytes encoded with it.
+func symbolStream(tb testing.TB) (lengths []uint, syms []int, data []byte) {
+	text := fixture(tb, "rfc1952.txt")
+	freq := make([]int, 256)
+	for i := range freq {
+		freq[i] = 1
+	}
+	for _, c := range text {
+		freq[c] += 100
+	}
+	enc := newHuffmanEncoder(freq, maxCodeLength)
+	var b bytes.Buffer
+	bw := newBitWriter(&b)
+	for _, c := range text {
+		enc.write(bw, int(c))
+		syms = append(syms, int(c))
+	}
+	// padding, so that the last codes can be decoded with a full lookahead
+	bw.writeBits(0, 16)
+	bw.writeBits(0, 16)
+	bw.align()
+	bw.flush()
+	return enc.lengths, syms, b.Bytes()
+}
+
+func TestHuffmanDecodersAgree(t *testing.T) {
+	lengths, syms, data := symbolStream(t)
+	var max uint
+	for _, l := range lengths {
+		if l > max {
+			max = l
+		}
+	}
+	if max <= huffmanRootBits {
+		t.Fatalf("longest code is %d bits, so no subtables are used", max)
+	}
+	tree, _ := buildHuffmanTree(lengths, nil)
+	table, err := newHuffmanDecoder(lengths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	treeBits, err := newBitReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tableBits, err := newBitReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range syms {
+		a, err := tree.decode(treeBits)
+		if err != nil {
+			t.Fatalf("symbol %d: tree: %v", i, err)
+		}
+		b, err := table.decode(tableBits)
+		if err != nil {
+			t.Fatalf("symbol %d: table: %v", i, err)
+		}
+		if a != want || b != want {
+			t.Fatalf("symbol %d: tree %d, table %d, want %d", i, a, b, want)
+		}
+	}
+}
+
+func benchmarkSymbolDecode(b *testing.B, decode func(*bitReader) (int, error)) {
+	_, syms, data := symbolStream(b)
+	b.SetBytes(int64(len(syms)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		br, err := newBitReader(bytes.NewReader(data))
+		if err != nil {
+			b.Fatal(err)
+		}
+		for range syms {
+			if _, err := decode(br); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+// BenchmarkTreeDecode and BenchmarkTableDecode decode the same symbols with
+// the same code, walking the tree a bit at a time and with table lookups.
+func BenchmarkTreeDecode(b *testing.B) {
+	lengths, _, _ := symbolStream(b)
+	tree, _ := buildHuffmanTree(lengths, nil)
+	benchmarkSymbolDecode(b, tree.decode)
+}
+
+func BenchmarkTableDecode(b *testing.B) {
+	lengths, _, _ := symbolStream(b)
+	table, err := newHuffmanDecoder(lengths)
+	if err != nil {
+		b.Fatal(err)
+	}
+	benchmarkSymbolDecode(b, table.decode)
+}
@@ -3,18 +3,82 @@ package hzip
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash"
+	"hash/crc32"
 	"io"
+	"io/ioutil"
 	"log"
+	"sync"
 	"time"
 )
 
 var (
-	ErrBadHeader = errors.New("hunzip: bad header")
+	ErrBadHeader         = errors.New("hunzip: bad header")
+	ErrBadStoredLength   = errors.New("hunzip: stored block length does not match its complement")
+	ErrChecksum          = errors.New("hunzip: invalid checksum")
+	ErrSize              = errors.New("hunzip: decoded size modulo 2^32 does not match ISIZE")
+	ErrBadExtra          = errors.New("hunzip: malformed extra field")
+	ErrBadHuffman        = errors.New("hunzip: invalid Huffman code lengths")
+	ErrDictionary        = errors.New("hunzip: stream requires a preset dictionary")
+	ErrHeaderCRC         = errors.New("hunzip: header checksum mismatch")
+	ErrOutputLimit       = errors.New("hunzip: decoded output exceeds MaxOutputSize")
+	ErrBadDistance       = errors.New("hunzip: back-reference distance exceeds decoded data")
+	ErrUnsupportedMethod = errors.New("hunzip: unsupported compression method")
+	ErrBadDictionary     = errors.New("hunzip: preset dictionary does not match DICTID")
+	ErrBadCode           = errors.New("hunzip: invalid Huffman code")
 )
 
+// ChecksumError reports a CRC32 trailer that does not match the decoded data.
+type ChecksumError struct {
+	Expected uint32
+	Computed uint32
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("%s: expected %08x, computed %08x", ErrChecksum, e.Expected, e.Computed)
+}
+
+// Is makes errors.Is(err, ErrChecksum) match a *ChecksumError.
+func (e *ChecksumError) Is(target error) bool {
+	return target == ErrChecksum
+}
+
+// HeaderError reports a header that could not be read, wrapping the cause.
+type HeaderError struct {
+	Err error
+}
+
+func (e *HeaderError) Error() string {
+	return fmt.Sprintf("%s: %v", ErrBadHeader, e.Err)
+}
+
+// Is makes errors.Is(err, ErrBadHeader) match a *HeaderError.
+func (e *HeaderError) Is(target error) bool {
+	return target == ErrBadHeader
+}
+
+func (e *HeaderError) Unwrap() error {
+	return e.Err
+}
+
+// MethodError reports a gzip header whose CM byte is not 8, deflate.
+type MethodError struct {
+	Method byte
+}
+
+func (e *MethodError) Error() string {
+	return fmt.Sprintf("%s: %d", ErrUnsupportedMethod, e.Method)
+}
+
+// Is makes errors.Is(err, ErrUnsupportedMethod) match a *MethodError.
+func (e *MethodError) Is(target error) bool {
+	return target == ErrUnsupportedMethod
+}
+
 const (
 	FTEXT    = 1 << 0
 	FHCRC    = 1 << 1
@@ -33,468 +97,1154 @@ type HuffmanTree struct {
 	one  *HuffmanTree
 }
 
-func (ht *HuffmanTree) pp(p uint) {
+func (ht *HuffmanTree) pp(w io.Writer, p uint) {
 	if ht.zero == nil && ht.one == nil {
-		fmt.Printf("%d:%d\n", p, ht.code)
+		fmt.Fprintf(w, "%d:%d\n", p, ht.code)
 		return
 	}
 	pp := p << 1
 	if ht.zero != nil {
-		ht.zero.pp(pp)
+		ht.zero.pp(w, pp)
 	}
 	if ht.one != nil {
-		ht.one.pp(pp | 1)
+		ht.one.pp(w, pp|1)
 	}
 }
 
-func (ht *HuffmanTree) Print() {
-	ht.pp(0)
+// Fprint writes the tree to w, one "path:code" line per leaf.
+func (ht *HuffmanTree) Fprint(w io.Writer) {
+	ht.pp(w, 0)
 }
 
-func buildHuffmanTree(m []uint) *HuffmanTree {
-	maxBitLength := uint(0)
-	maxCode := 0
-	for k, v := range m {
-		if maxBitLength < v {
-			maxBitLength = v
+// decode reads bits from br, walking from ht to a leaf, and returns the leaf's
+// code. It fails with ErrBadCode when the bits lead off the tree.
+func (ht *HuffmanTree) decode(br *bitReader) (int, error) {
+	node := ht
+	for node.zero != nil || node.one != nil {
+		b, err := br.readBit()
+		if err != nil {
+			return 0, err
+		}
+		if b > 0 {
+			node = node.one
+		} else {
+			node = node.zero
 		}
-		if v > 0 && k > maxCode {
-			maxCode = k
+		if node == nil {
+			return 0, ErrBadCode
 		}
 	}
+	if node.code < 0 {
+		return 0, ErrBadCode
+	}
+	return node.code, nil
+}
+
+// maxCodeLength is the longest code length DEFLATE allows.
+const maxCodeLength = 15
 
-	blcount := make([]int, maxBitLength+1)
+// buildHuffmanTree builds the tree of the canonical code with code lengths m,
+// which must be at most maxCodeLength. The nodes are allocated from nodes when
+// it has room, and the slice holding them is returned so that the next call
+// can reuse it.
+func buildHuffmanTree(m []uint, nodes []HuffmanTree) (*HuffmanTree, []HuffmanTree) {
+	// a code with k symbols needs at most one node per code bit, plus the root
+	need := 1
+	var blcount [maxCodeLength + 1]int
 	for _, v := range m {
 		blcount[v]++
+		need += int(v)
 	}
+	blcount[0] = 0
 
 	code := 0
-	nextCode := make([]int, maxBitLength+1)
-	for b := uint(1); b <= maxBitLength; b++ {
+	var nextCode [maxCodeLength + 1]int
+	for b := 1; b <= maxCodeLength; b++ {
 		code = (code + blcount[b-1]) << 1
-		if blcount[b] > 0 {
-			nextCode[b] = code
-		}
+		nextCode[b] = code
 	}
 
-	for k, v := range blcount {
-		fmt.Printf("[%d:%d]", k, v)
+	if cap(nodes) < need {
+		nodes = make([]HuffmanTree, 0, need)
 	}
-
-	fmt.Println("")
-
-	// for k, v := range nextCode {
-	// 	fmt.Printf("[%d:%d]", k, v)
-	// }
-	// fmt.Println("")
-	codes := make([]int, maxCode+1)
-	for n := 0; n <= maxCode; n++ {
-		ln := m[n]
-		if ln > 0 {
-			codes[n] = nextCode[ln]
-			nextCode[ln]++
+	nodes = append(nodes[:0], HuffmanTree{code: -1})
+	root := &nodes[0]
+	for n, ln := range m {
+		if ln == 0 {
+			continue
 		}
-	}
-
-	root := &HuffmanTree{
-		code: -1,
-	}
-	for n := 0; n <= maxCode; n++ {
+		c := nextCode[ln]
+		nextCode[ln]++
 		node := root
-
-		if m[n] > 0 {
-			for b := uint(m[n]); b > 0; b-- {
-				if codes[n]&(1<<(b-1)) > 0 {
-					if node.one == nil {
-						node.one = &HuffmanTree{
-							code: -1,
-						}
-					}
-					node = node.one
-				} else {
-					if node.zero == nil {
-						node.zero = &HuffmanTree{
-							code: -1,
-						}
-					}
-					node = node.zero
-				}
+		for b := ln; b > 0; b-- {
+			next := &node.zero
+			if c&(1<<(b-1)) > 0 {
+				next = &node.one
 			}
-			node.code = n
+			if *next == nil {
+				nodes = append(nodes, HuffmanTree{code: -1})
+				*next = &nodes[len(nodes)-1]
+			}
+			node = *next
 		}
+		node.code = n
 	}
 
-	return root
+	return root, nodes
+}
+
+var (
+	fixedOnce     sync.Once
+	fixedLiteral  *huffmanDecoder
+	fixedDistance *huffmanDecoder
+)
+
+// fixedHuffmanDecoders returns the literal/length and distance codes of the
+// fixed Huffman code defined in RFC 1951 section 3.2.6.
+func fixedHuffmanDecoders() (*huffmanDecoder, *huffmanDecoder) {
+	fixedOnce.Do(func() {
+		var lit [288]uint
+		for i := range lit {
+			switch {
+			case i < 144:
+				lit[i] = 8
+			case i < 256:
+				lit[i] = 9
+			case i < 280:
+				lit[i] = 7
+			default:
+				lit[i] = 8
+			}
+		}
+		var dist [32]uint
+		for i := range dist {
+			dist[i] = 5
+		}
+		// the fixed code lengths are known to be valid
+		fixedLiteral, _ = newHuffmanDecoder(lit[:])
+		fixedDistance, _ = newHuffmanDecoder(dist[:])
+	})
+	return fixedLiteral, fixedDistance
 }
 
+// bitReader reads the LSB-first bit stream of DEFLATE. Bits are buffered in
+// bits, with nbits of them valid, and bytes are only pulled from r when more
+// bits are needed so that the reader never reads far past the deflate stream.
+//
+// The bit stream is always followed by at least the member trailer, so
+// running out of input is reported as io.ErrUnexpectedEOF.
 type bitReader struct {
-	r    *bufio.Reader
-	buf  uint8
-	mask uint8
+	r     io.ByteReader
+	bits  uint32
+	nbits uint
 }
 
-func newBitReader(r io.Reader) (*bitReader, error) {
-	rr := bufio.NewReader(r)
-	buf, err := rr.ReadByte()
-	if err != nil {
+// newBitReader starts reading a DEFLATE body from r. Every body holds at
+// least one block, so a body with no bytes at all is io.ErrUnexpectedEOF.
+func newBitReader(r io.ByteReader) (*bitReader, error) {
+	br := new(bitReader)
+	if err := br.reset(r); err != nil {
 		return nil, err
 	}
-	mask := 0x01
-	return &bitReader{
-		r:    rr,
-		buf:  uint8(buf),
-		mask: uint8(mask),
-	}, nil
+	return br, nil
 }
 
-func (br *bitReader) readBit() (uint8, error) {
-	var bit uint8 = br.buf & br.mask
-	if bit > 0 {
-		bit = 1
-	}
-	br.mask = br.mask << 1
-	if br.mask == 0 {
-		br.mask = 0x01
+// reset discards any buffered bits and starts reading a new DEFLATE body from
+// r, as newBitReader does.
+func (br *bitReader) reset(r io.ByteReader) error {
+	*br = bitReader{r: r}
+	return br.fill(8)
+}
+
+// fill makes at least n bits available, if the input has that many.
+func (br *bitReader) fill(n uint) error {
+	for br.nbits < n {
 		b, err := br.r.ReadByte()
 		if err != nil {
-			return 0, err
+			return readError(err)
 		}
-		br.buf = uint8(b)
+		br.bits |= uint32(b) << br.nbits
+		br.nbits += 8
+	}
+	return nil
+}
+
+func (br *bitReader) readBit() (uint8, error) {
+	if err := br.fill(1); err != nil {
+		return 0, err
 	}
+	bit := uint8(br.bits & 1)
+	br.bits >>= 1
+	br.nbits--
 	return bit, nil
 }
 
-func (br *bitReader) readBits(c uint) (uint, error) {
-	var bits uint = 0
+// align discards the remaining bits of a partially consumed byte so the next
+// read starts on a byte boundary.
+func (br *bitReader) align() {
+	n := br.nbits % 8
+	br.bits >>= n
+	br.nbits -= n
+}
 
-	for i := uint(0); i < c; i++ {
-		b, err := br.readBit()
+// readByte reads a whole byte. The reader must be aligned.
+func (br *bitReader) readByte() (uint8, error) {
+	if br.nbits >= 8 {
+		b := uint8(br.bits)
+		br.bits >>= 8
+		br.nbits -= 8
+		return b, nil
+	}
+	b, err := br.r.ReadByte()
+	if err != nil {
+		return 0, readError(err)
+	}
+	return uint8(b), nil
+}
+
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// readError wraps an error from the compressed input, in which the end of the
+// input is io.ErrUnexpectedEOF.
+func readError(err error) error {
+	return fmt.Errorf("hunzip: reading compressed data: %w", noEOF(err))
+}
+
+// readUint32 reads a little-endian uint32. The reader must be aligned.
+func (br *bitReader) readUint32() (uint32, error) {
+	b, err := br.readBytes(4)
+	if err != nil {
+		return 0, err
+	}
+	return le.Uint32(b), nil
+}
+
+// readBytes reads n whole bytes, taking the bytes still buffered in bits
+// before reading more from r. The reader must be aligned.
+func (br *bitReader) readBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	for i := range b {
+		c, err := br.readByte()
 		if err != nil {
-			return 0, err
+			return nil, err
 		}
-		bits |= (uint(b) << i)
+		b[i] = c
 	}
+	return b, nil
+}
 
+// readBits reads c bits, c <= 16, as an LSB-first integer. The bits are
+// filled before any are consumed, so input ending partway through a field,
+// such as HLIT or HCLEN, is io.ErrUnexpectedEOF and never a partial value.
+func (br *bitReader) readBits(c uint) (uint, error) {
+	if err := br.fill(c); err != nil {
+		return 0, err
+	}
+	bits := uint(br.bits & (1<<c - 1))
+	br.bits >>= c
+	br.nbits -= c
 	return bits, nil
 }
 
+// Header holds the gzip member header, with the same fields as the header of
+// compress/gzip. IsText reports the FTEXT flag, a hint that the data is
+// probably ASCII text. ModTime is in UTC, and is the zero time when the
+// member records no timestamp (an MTIME of 0).
+//
+// RFC 1952 specifies ISO 8859-1 for the name and comment. Name and Comment
+// are UTF-8 on both sides: the reader decodes them with Latin1ToUTF8 and the
+// Writer encodes them back. NameBytes and CommentBytes hold the bytes as
+// stored; only the reader sets them, and the Writer ignores them.
+//
+// XFL holds the extra flags, which for DEFLATE are 2 when the compressor used
+// its slowest, best compression and 4 when it used its fastest.
+type Header struct {
+	Comment string
+	Extra   []byte
+	ModTime time.Time
+	Name    string
+	OS      byte
+	XFL     byte
+	IsText  bool
+
+	NameBytes    []byte
+	CommentBytes []byte
+}
+
+// Latin1ToUTF8 decodes ISO 8859-1 text, such as a header name or comment.
+func Latin1ToUTF8(b []byte) string {
+	r := make([]rune, len(b))
+	for i, c := range b {
+		r[i] = rune(c)
+	}
+	return string(r)
+}
+
+// HasModTime reports whether the header records a modification time.
+func (h *Header) HasModTime() bool {
+	return !h.ModTime.IsZero()
+}
+
+// Subfield is one subfield of the extra field, identified by SI1 and SI2.
+type Subfield struct {
+	SI1, SI2 byte
+	Data     []byte
+}
+
+// Subfields parses the whole extra field into its subfields, in order. It
+// returns ErrBadExtra when a subfield runs past the end of the field. The
+// data of each subfield aliases Extra.
+func (h *Header) Subfields() ([]Subfield, error) {
+	var fields []Subfield
+	b := h.Extra
+	for len(b) > 0 {
+		if len(b) < 4 {
+			return nil, ErrBadExtra
+		}
+		n := int(le.Uint16(b[2:4]))
+		if len(b) < 4+n {
+			return nil, ErrBadExtra
+		}
+		fields = append(fields, Subfield{SI1: b[0], SI2: b[1], Data: b[4 : 4+n]})
+		b = b[4+n:]
+	}
+	return fields, nil
+}
+
+// BGZFBlockSize returns the total size of the member, header and trailer
+// included, recorded by BGZF in the BC extra subfield as BSIZE, the size
+// minus one. It reports false when the subfield is missing or malformed.
+func (h *Header) BGZFBlockSize() (int, bool) {
+	b, ok, err := h.ExtraSubfield('B', 'C')
+	if err != nil || !ok || len(b) != 2 {
+		return 0, false
+	}
+	return int(le.Uint16(b)) + 1, true
+}
+
+// osNames are the operating systems of RFC 1952 section 2.3.1, by OS code.
+var osNames = [...]string{
+	"FAT filesystem",
+	"Amiga",
+	"VMS",
+	"Unix",
+	"VM/CMS",
+	"Atari TOS",
+	"HPFS filesystem",
+	"Macintosh",
+	"Z-System",
+	"CP/M",
+	"TOPS-20",
+	"NTFS filesystem",
+	"QDOS",
+	"Acorn RISCOS",
+}
+
+// OSName returns the name of the operating system recorded in the OS field,
+// or "unknown" for 255 and unassigned codes.
+func (h *Header) OSName() string {
+	if int(h.OS) < len(osNames) {
+		return osNames[h.OS]
+	}
+	return "unknown"
+}
+
+// ExtraSubfield looks up the subfield with the given SI1 and SI2 identifiers
+// in the extra field, which is parsed as a sequence of SI1, SI2, LEN and
+// LEN bytes of data per RFC 1952 section 2.3.1.1.
+func (h *Header) ExtraSubfield(si1, si2 byte) ([]byte, bool, error) {
+	b := h.Extra
+	for len(b) > 0 {
+		if len(b) < 4 {
+			return nil, false, ErrBadExtra
+		}
+		n := int(le.Uint16(b[2:4]))
+		if len(b) < 4+n {
+			return nil, false, ErrBadExtra
+		}
+		if b[0] == si1 && b[1] == si2 {
+			return b[4 : 4+n], true, nil
+		}
+		b = b[4+n:]
+	}
+	return nil, false, nil
+}
+
+// ReaderBuilder reads a gzip stream. Its Header describes the member being
+// decoded, starting with the first one, whose header is parsed by
+// NewReaderBuilder.
 type ReaderBuilder struct {
-	r *bufio.Reader
+	orig        io.Reader
+	buf         *bufio.Reader
+	src         *countingReader
+	d           *decompressor
+	multistream bool
+	bufferSize  int
+	dict        []byte
+
+	collectStats bool
+	textMode     bool
+	capture      io.Writer
+	concurrency  int
+	strict       bool
+	fixedOutput  bool
+
+	Header
+	CRC16 int
+
+	// MaxOutputSize limits the total number of decoded bytes across all
+	// members. Decoding fails with ErrOutputLimit once the stream would
+	// produce more. Zero means no limit.
+	MaxOutputSize int64
+
+	// Logger receives debug messages about the decoded stream when set.
+	Logger *log.Logger
+}
+
+// Option configures a ReaderBuilder created by NewReaderBuilder. Options
+// also configure NewZlibReader and NewDeflateReader, which ignore WithLogger
+// and WithMultistream.
+type Option func(*ReaderBuilder)
+
+// WithMaxOutputSize sets MaxOutputSize.
+func WithMaxOutputSize(n int64) Option {
+	return func(rb *ReaderBuilder) {
+		rb.MaxOutputSize = n
+	}
+}
+
+// WithLogger sets Logger.
+func WithLogger(l *log.Logger) Option {
+	return func(rb *ReaderBuilder) {
+		rb.Logger = l
+	}
+}
+
+// WithMultistream sets whether concatenated members are decoded, as with
+// Multistream. Without multistream, the input following the first member is
+// available from Remaining.
+func WithMultistream(ok bool) Option {
+	return func(rb *ReaderBuilder) {
+		rb.multistream = ok
+	}
+}
+
+// WithBufferSize sets the size of the buffer used to read the compressed
+// stream. The default is the bufio default of 4KB; large sequential reads
+// benefit from a larger buffer, such as 64KB. Reset keeps the size.
+func WithBufferSize(n int) Option {
+	return func(rb *ReaderBuilder) {
+		rb.bufferSize = n
+	}
+}
 
-	Time     time.Time
-	FileName string
-	Comment  string
-	OS       int
-	CRC16    int
+// WithDictionary sets the preset dictionary of a raw DEFLATE stream, or of a
+// zlib stream whose header sets FDICT. It is ignored for gzip streams, which
+// have no dictionary.
+func WithDictionary(dict []byte) Option {
+	return func(rb *ReaderBuilder) {
+		rb.dict = dict
+	}
 }
 
-func NewReaderBuilder(r io.Reader) (*ReaderBuilder, error) {
-	ret := &ReaderBuilder{
-		r: bufio.NewReader(r),
+// WithRawCapture copies every byte read from the compressed source to w as
+// decoding proceeds, headers and trailers included. The source is then always
+// buffered, so w may also receive input read ahead of the decoder.
+func WithRawCapture(w io.Writer) Option {
+	return func(rb *ReaderBuilder) {
+		rb.capture = w
 	}
+}
+
+// WithStrict rejects headers that RFC 1952 does not allow but that decode
+// fine otherwise: reserved FLG bits that are set, and XFL values other than 0,
+// 2 and 4. They are ErrBadHeader.
+func WithStrict() Option {
+	return func(rb *ReaderBuilder) {
+		rb.strict = true
+	}
+}
+
+// applyOptions returns a ReaderBuilder holding the defaults updated by opts.
+func applyOptions(opts []Option) *ReaderBuilder {
+	rb := &ReaderBuilder{multistream: true}
+	for _, opt := range opts {
+		opt(rb)
+	}
+	return rb
+}
+
+// byteReader is the input decoded from. A source that is an io.ByteReader,
+// such as a bufio.Reader or a bytes.Reader, is used directly; any other
+// source is buffered.
+type byteReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// newBuffer returns the reader over r to decode from. It reuses rb.buf, if
+// any, to buffer r.
+func (rb *ReaderBuilder) newBuffer(r io.Reader) byteReader {
+	if rb.capture != nil {
+		r = io.TeeReader(r, rb.capture)
+	}
+	if br, ok := r.(byteReader); ok {
+		return br
+	}
+	switch {
+	case rb.buf != nil:
+		rb.buf.Reset(r)
+	case rb.bufferSize > 0:
+		rb.buf = bufio.NewReaderSize(r, rb.bufferSize)
+	default:
+		rb.buf = bufio.NewReader(r)
+	}
+	return rb.buf
+}
+
+// NewReaderBuilder reads the header of the first gzip member from r. The
+// header fields can be inspected as soon as it returns: no body data is
+// decoded until the reader returned by Reader is read, which then continues
+// from just after the header.
+//
+// When r is an io.ByteReader it is read from directly, a byte at a time, and
+// is left positioned just after the data consumed. Other sources are
+// buffered, and may be read past the end of the gzip stream.
+func NewReaderBuilder(r io.Reader, opts ...Option) (*ReaderBuilder, error) {
+	ret := applyOptions(opts)
+	ret.orig = r
+	ret.src = &countingReader{r: ret.newBuffer(r)}
 	if err := ret.readHeaders(); err != nil {
 		return nil, err
 	}
 	return ret, nil
 }
 
+// Reset discards the state of the builder and makes it read the header of a
+// new gzip stream from r, reusing the existing buffer.
+func (rb *ReaderBuilder) Reset(r io.Reader) error {
+	rb.orig = r
+	rb.src = &countingReader{r: rb.newBuffer(r)}
+	rb.d = nil
+	return rb.readHeaders()
+}
+
+// Trailer returns the CRC32 and ISIZE fields of the trailer of the last member
+// in the stream. When the source passed to NewReaderBuilder or Reset is an
+// io.ReadSeeker, they are read from the last 8 bytes without decoding any
+// body, and the source is then returned to its position. Otherwise the rest
+// of the stream is decoded and discarded, so Reader must not be used
+// afterwards.
+func (rb *ReaderBuilder) Trailer() (crc, size uint32, err error) {
+	if s, ok := rb.orig.(io.ReadSeeker); ok {
+		return readTrailer(s)
+	}
+	if rb.d == nil {
+		if _, err := rb.Reader(); err != nil {
+			return 0, 0, err
+		}
+	}
+	if _, err := io.Copy(ioutil.Discard, rb.d); err != nil {
+		return 0, 0, err
+	}
+	return rb.d.trailerCRC, rb.d.trailerSize, nil
+}
+
+// SkipMember reads the header of the member at the current position of r and
+// leaves r at the start of the next member, returning the header. It returns
+// io.EOF when r is at its end. The extent of a BGZF member is read from its
+// header, so its body is not decoded; the body of any other member has to be
+// decoded, and is discarded, to find where it ends.
+func SkipMember(r io.ReadSeeker, opts ...Option) (*Header, error) {
+	start, err := r.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	end, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	if start >= end {
+		return nil, io.EOF
+	}
+	if _, err := r.Seek(start, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	opts = append(opts[:len(opts):len(opts)], WithMultistream(false))
+	rb, err := NewReaderBuilder(r, opts...)
+	if err != nil {
+		return nil, err
+	}
+	n, ok := rb.BGZFBlockSize()
+	size := int64(n)
+	if !ok {
+		zr, err := rb.Reader()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.Copy(ioutil.Discard, zr); err != nil {
+			return nil, err
+		}
+		size = rb.BytesRead()
+	}
+	if _, err := r.Seek(start+size, io.SeekStart); err != nil {
+		return nil, err
+	}
+	h := rb.Header
+	return &h, nil
+}
+
+// readTrailer reads the last 8 bytes of s, restoring its position afterwards.
+func readTrailer(s io.ReadSeeker) (crc, size uint32, err error) {
+	pos, err := s.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, 0, err
+	}
+	if _, err := s.Seek(-8, io.SeekEnd); err != nil {
+		return 0, 0, err
+	}
+	var b [8]byte
+	_, err = io.ReadFull(s, b[:])
+	if _, serr := s.Seek(pos, io.SeekStart); err == nil {
+		err = serr
+	}
+	if err != nil {
+		return 0, 0, noEOF(err)
+	}
+	return le.Uint32(b[0:4]), le.Uint32(b[4:8]), nil
+}
+
+// BytesRead returns the number of compressed bytes consumed so far, counting
+// headers, bodies and trailers. Once a member has been fully decoded it is the
+// offset just past that member's trailer in the source, even though the
+// builder may have buffered input beyond it.
+func (rb *ReaderBuilder) BytesRead() int64 {
+	n := rb.src.n
+	if rb.d != nil && rb.d.br != nil {
+		n -= int64(rb.d.br.nbits / 8)
+	}
+	return n
+}
+
+// Remaining returns a reader of the input past what has been consumed so far,
+// starting with whatever the builder has buffered and continuing with the
+// source. Once a member read without multistream has been fully decoded, it
+// starts just after that member's trailer, so the caller can go on reading
+// the following members. The builder must not be used afterwards.
+func (rb *ReaderBuilder) Remaining() io.Reader {
+	var prefix []byte
+	if d := rb.d; d != nil && d.br != nil {
+		d.br.align()
+		for d.br.nbits > 0 {
+			b, _ := d.br.readByte()
+			prefix = append(prefix, b)
+		}
+	}
+	if rb.src.pending {
+		rb.src.pending = false
+		prefix = append(prefix, rb.src.last)
+	}
+	if len(prefix) == 0 {
+		return rb.src.r
+	}
+	return io.MultiReader(bytes.NewReader(prefix), rb.src.r)
+}
+
+// countingReader counts the bytes consumed from r. It can also push back the
+// last byte read, which is how the start of another member is detected.
+type countingReader struct {
+	r       byteReader
+	n       int64
+	last    byte
+	pending bool
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	if c.pending && len(p) > 0 {
+		c.pending = false
+		p[0] = c.last
+		c.n++
+		return 1, nil
+	}
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countingReader) ReadByte() (byte, error) {
+	if c.pending {
+		c.pending = false
+	} else {
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		c.last = b
+	}
+	c.n++
+	return c.last, nil
+}
+
+// UnreadByte pushes back the last byte read by ReadByte.
+func (c *countingReader) UnreadByte() error {
+	c.pending = true
+	c.n--
+	return nil
+}
+
+func (rb *ReaderBuilder) logf(format string, v ...interface{}) {
+	if rb.Logger != nil {
+		rb.Logger.Printf(format, v...)
+	}
+}
+
+// Multistream controls whether concatenated gzip members are decoded as one
+// stream. It is enabled by default; when disabled only the first member is
+// decoded. The header fields always describe the last member read.
+//
+// After a member, input that does not start with the gzip magic 0x1f, such as
+// NUL padding, is ignored as trailing data and ends the stream. Input that
+// does start with 0x1f must be a complete, valid header.
+func (rb *ReaderBuilder) Multistream(ok bool) {
+	rb.multistream = ok
+}
+
 func (hunzip *ReaderBuilder) readHeaders() error {
+	// digest covers every header byte for the optional FHCRC check
+	digest := crc32.NewIEEE()
+
 	header := make([]byte, 10)
-	n, err := hunzip.r.Read(header)
-	if err != nil || n != 10 {
-		return ErrBadHeader
+	if _, err := io.ReadFull(hunzip.src, header); err != nil {
+		return &HeaderError{Err: err}
 	}
+	digest.Write(header)
 
-	if header[0] != 0x1f || header[1] != 0x8b || header[2] != 8 {
+	if header[0] != 0x1f || header[1] != 0x8b {
 		return ErrBadHeader
 	}
+	if header[2] != 8 {
+		return &MethodError{Method: header[2]}
+	}
 
 	flg := header[3]
+	if hunzip.strict {
+		if flg&0xe0 != 0 {
+			return fmt.Errorf("%w: reserved flags %#02x set", ErrBadHeader, flg&0xe0)
+		}
+		if xfl := header[8]; xfl != 0 && xfl != 2 && xfl != 4 {
+			return fmt.Errorf("%w: undefined XFL %d", ErrBadHeader, xfl)
+		}
+	}
+
+	hunzip.Header = Header{}
+	hunzip.CRC16 = 0
 
 	if t := le.Uint32(header[4:8]); t > 0 {
-		hunzip.Time = time.Unix(int64(t), 0)
+		hunzip.ModTime = time.Unix(int64(t), 0).UTC()
 	}
-	hunzip.OS = int(header[9])
+	hunzip.XFL = header[8]
+	hunzip.OS = header[9]
+	hunzip.IsText = flg&FTEXT > 0
 
 	if flg&FEXTRA > 0 {
-		// read and ignore the content
 		b := make([]byte, 2)
-		n, err := hunzip.r.Read(b)
-		if err != nil || n != 2 {
-			return ErrBadHeader
+		if _, err := io.ReadFull(hunzip.src, b); err != nil {
+			return &HeaderError{Err: noEOF(err)}
 		}
+		digest.Write(b)
 		xlen := le.Uint16(b)
 		b = make([]byte, xlen)
-		n, err = hunzip.r.Read(b)
-		if err != nil || n != 2 {
-			return ErrBadHeader
+		if _, err := io.ReadFull(hunzip.src, b); err != nil {
+			return &HeaderError{Err: noEOF(err)}
 		}
+		digest.Write(b)
+		hunzip.Extra = b
 	}
 	if flg&FNAME > 0 {
-		hunzip.FileName, err = hunzip.r.ReadString(0x00)
+		b, err := hunzip.readString(digest)
 		if err != nil {
-			return ErrBadHeader
+			return err
 		}
+		hunzip.Name = Latin1ToUTF8(b)
+		hunzip.NameBytes = b
 	}
 	if flg&FCOMMENT > 0 {
-		hunzip.Comment, err = hunzip.r.ReadString(0x00)
+		b, err := hunzip.readString(digest)
 		if err != nil {
-			return ErrBadHeader
+			return err
 		}
+		hunzip.Comment = Latin1ToUTF8(b)
+		hunzip.CommentBytes = b
 	}
 	if flg&FHCRC > 0 {
 		b := make([]byte, 2)
-		n, err := hunzip.r.Read(b)
-		if err != nil || n != 2 {
-			return ErrBadHeader
+		if _, err := io.ReadFull(hunzip.src, b); err != nil {
+			return &HeaderError{Err: noEOF(err)}
 		}
 		hunzip.CRC16 = int(le.Uint16(b))
+		if uint16(digest.Sum32()) != uint16(hunzip.CRC16) {
+			return ErrHeaderCRC
+		}
 	}
 
-	// log.Printf("time: %s, name: %s, comment: %s, OS: %d, CRC16: %d",
-	// 	hunzip.Time,
-	// 	hunzip.FileName,
-	// 	hunzip.Comment,
-	// 	hunzip.OS,
-	// 	hunzip.CRC16)
+	hunzip.logf("header: time=%s name=%q comment=%q os=%d text=%t crc16=%d",
+		hunzip.ModTime,
+		hunzip.Name,
+		hunzip.Comment,
+		hunzip.OS,
+		hunzip.IsText,
+		hunzip.CRC16)
 
 	return nil
 }
 
-func (rb *ReaderBuilder) Reader() (io.Reader, error) {
-	b, err := rb.unzip()
+// NewReader reads the gzip header from r and returns a reader of the
+// decompressed data, for callers that do not need to inspect the header
+// before decoding.
+func NewReader(r io.Reader, opts ...Option) (io.ReadCloser, error) {
+	rb, err := NewReaderBuilder(r, opts...)
 	if err != nil {
 		return nil, err
 	}
-	return bytes.NewReader(b), nil
+	rb.newDecompressor()
+	return rb.wrapText(rb.d), nil
 }
 
-func (br *ReaderBuilder) unzip() ([]byte, error) {
-	var bFinal uint8 = 1
-	ret := make([]byte, 0)
-	r, err := newBitReader(br.r)
+// Decompress decodes a complete gzip stream held in memory. A stream of empty
+// members decodes to an empty, non-nil slice. The output is allocated up
+// front from the ISIZE of the last trailer, which is exact for a single
+// member smaller than 4GB.
+func Decompress(data []byte) ([]byte, error) {
+	rb, err := NewReaderBuilder(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	r, err := rb.Reader()
 	if err != nil {
 		return nil, err
 	}
-	for bFinal > 0 {
-		bFinal, err = r.readBit()
+	out := bytes.NewBuffer(make([]byte, 0, sizeHint(data)))
+	_, err = io.Copy(out, r)
+	return out.Bytes(), err
+}
+
+// maxRatio bounds the expansion of DEFLATE: a match of 258 bytes takes at
+// least one bit for its length and one for its distance.
+const maxRatio = 1032
+
+// sizeHint returns the ISIZE of the last trailer in data, capped at what data
+// could possibly decode to so that a corrupt trailer cannot force a huge
+// allocation.
+func sizeHint(data []byte) int {
+	if len(data) < 8 {
+		return 0
+	}
+	n := int64(le.Uint32(data[len(data)-4:]))
+	if max := int64(len(data)) * maxRatio; n > max {
+		n = max
+	}
+	return int(n)
+}
+
+// DecompressInto decodes a complete gzip stream held in memory into dst,
+// starting at dst[0], and returns the slice of dst holding the output. When
+// the output does not fit, a larger buffer is allocated, sized from the last
+// trailer's ISIZE, unless WithFixedOutput is given, in which case DecompressInto
+// fails with io.ErrShortBuffer and returns dst filled with the start of the
+// output.
+func DecompressInto(dst, src []byte, opts ...Option) ([]byte, error) {
+	cfg := applyOptions(opts)
+	r, err := NewReader(bytes.NewReader(src), opts...)
+	if err != nil {
+		return dst[:0], err
+	}
+	defer r.Close()
+	out := dst[:0]
+	if hint := sizeHint(src); !cfg.fixedOutput && cap(out) < hint {
+		out = make([]byte, 0, hint)
+	}
+	for {
+		if len(out) == cap(out) {
+			// only grow once there is more output
+			var b [1]byte
+			if n, err := io.ReadFull(r, b[:]); n == 0 {
+				if err == io.EOF {
+					err = nil
+				}
+				return out, err
+			}
+			if cfg.fixedOutput {
+				return out, io.ErrShortBuffer
+			}
+			out = append(out, b[0])
+			continue
+		}
+		n, err := r.Read(out[len(out):cap(out)])
+		out = out[:len(out)+n]
+		if err == io.EOF {
+			return out, nil
+		}
 		if err != nil {
-			return nil, err
+			return out, err
 		}
-		bType, err := r.readBits(2)
+	}
+}
+
+// WithFixedOutput makes DecompressInto fail with io.ErrShortBuffer rather than
+// allocate when the output does not fit in dst.
+func WithFixedOutput() Option {
+	return func(rb *ReaderBuilder) {
+		rb.fixedOutput = true
+	}
+}
+
+// readString reads a NUL-terminated header field, dropping the terminator.
+func (hunzip *ReaderBuilder) readString(digest hash.Hash32) ([]byte, error) {
+	var b []byte
+	for {
+		c, err := hunzip.src.ReadByte()
 		if err != nil {
-			return nil, err
+			return nil, &HeaderError{Err: noEOF(err)}
 		}
-		// log.Printf("bType: %d", bType)
-		switch bType {
-		case 0:
-			return nil, errors.New("unsupported uncompressed")
-		case 1:
-			return nil, errors.New("unspported compression with fixed huffman")
-		case 2:
-			b, err := br.unzipDynamicHuffman(r)
-			if err != nil {
-				return nil, err
-			}
-			ret = append(ret, b...)
-		case 3:
-			return nil, errors.New("bad bType")
+		if c == 0x00 {
+			break
 		}
+		b = append(b, c)
+	}
+	digest.Write(b)
+	digest.Write([]byte{0x00})
+	return b, nil
+}
 
+// Reader returns a reader that decodes the body following the header. Data
+// is decompressed incrementally as it is read, and the CRC-32 and size are
+// updated as it is, so each member is verified against its trailer with only
+// the 32KB window held in memory. A body that ends before a block marked
+// final, even right after a complete block, is io.ErrUnexpectedEOF rather
+// than a short but clean read. The reader also implements io.Closer.
+func (rb *ReaderBuilder) Reader() (io.Reader, error) {
+	rb.newDecompressor()
+	return rb.wrapText(rb.d), nil
+}
+
+// ReaderWithContext is like Reader, but decoding stops with the context's
+// error once ctx is done. The context is checked before every block and every
+// 32KB of output.
+func (rb *ReaderBuilder) ReaderWithContext(ctx context.Context) (io.Reader, error) {
+	rb.newDecompressor()
+	rb.d.ctx = ctx
+	return rb.wrapText(rb.d), nil
+}
+
+func (rb *ReaderBuilder) newDecompressor() {
+	rb.d = &decompressor{rb: rb, r: rb.src, max: rb.MaxOutputSize}
+	rb.d.startStats()
+}
+
+// readStoredHeader reads the LEN and NLEN fields of a stored block.
+func (d *decompressor) readStoredHeader(r *bitReader) error {
+	r.align()
+	hdr, err := r.readBytes(4)
+	if err != nil {
+		return err
 	}
-	return ret, nil
+	ln := le.Uint16(hdr[0:2])
+	nln := le.Uint16(hdr[2:4])
+	if ln != ^nln {
+		return ErrBadStoredLength
+	}
+	d.stored = int(ln)
+	return nil
 }
 
-func (br *ReaderBuilder) unzipDynamicHuffman(r *bitReader) ([]byte, error) {
+// unzipStored and inflate append the decoded block to buf, which holds the
+// previously decoded output so that back-references can reach across block
+// boundaries. They stop once buf reaches limit bytes, or at the end of the
+// block, in which case d.block is reset.
+func (d *decompressor) unzipStored(r *bitReader, buf []byte, limit int) ([]byte, error) {
+	for d.stored > 0 && len(buf) < limit {
+		b, err := r.readByte()
+		if err != nil {
+			return nil, err
+		}
+		buf = append(buf, b)
+		d.stored--
+	}
+	if d.stored == 0 {
+		d.block = blockNone
+	}
+	return buf, nil
+}
+
+// readDynamicHuffman reads the code lengths of a dynamic block and returns
+// its literal/length and distance codes.
+func (d *decompressor) readDynamicHuffman(r *bitReader) (*huffmanDecoder, *huffmanDecoder, error) {
 	hlit, err := r.readBits(5)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	hdist, err := r.readBits(5)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	hclen, err := r.readBits(4)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	// log.Printf("hlit=%d, hdist=%d, hclen=%d", hlit, hdist, hclen)
+	d.logf("dynamic block: hlit=%d hdist=%d hclen=%d", hlit, hdist, hclen)
 
-	offset := []int{16, 17, 18, 0, 8, 7, 9, 6, 10, 5, 11, 4, 12, 3, 13, 2, 14, 1, 15}
 	var clength [19]uint
 	for i := uint(0); i < hclen+4; i++ {
-		clength[offset[i]], err = r.readBits(3)
+		clength[codeLengthOrder[i]], err = r.readBits(3)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 	}
 
-	tree := buildHuffmanTree(clength[:])
-	// tree.Print()
-	// log.Println("----")
-
-	state := tree
-	alphabet := make([]uint, hlit+hdist+258)
-	var i uint = 0
-	for i < hlit+hdist+258 {
-		b, err := r.readBit()
-		if err != nil {
-			return nil, err
-		}
-		if b > 0 {
-			state = state.one
-		} else {
-			state = state.zero
-		}
-		if state.zero == nil && state.one == nil {
-			if state.code > 15 {
-				var repeat uint
-				var err error
-				switch state.code {
-				case 16:
-					repeat, err = r.readBits(2)
-					if err != nil {
-						return nil, err
-					}
-					repeat += 3
-				case 17:
-					repeat, err = r.readBits(3)
-					if err != nil {
-						return nil, err
-					}
-					repeat += 3
-				case 18:
-					repeat, err = r.readBits(7)
-					if err != nil {
-						return nil, err
-					}
-					repeat += 11
-				default:
-					return nil, errors.New("can't be more than 18")
-				}
-				for repeat > 0 {
-					repeat--
-					if state.code == 16 {
-						alphabet[i] = alphabet[i-1]
-					} else {
-						alphabet[i] = 0
-					}
-					i++
-				}
-			} else {
-				alphabet[i] = uint(state.code)
-				i++
-			}
-			state = tree
-		}
+	// the lengths left out by a small HCLEN are zero; the code they leave
+	// must still be complete, or the tree would have missing branches
+	if err := checkCodeLengths(clength[:]); err != nil {
+		return nil, nil, err
 	}
+	var tree *HuffmanTree
+	tree, d.clTree = buildHuffmanTree(clength[:], d.clTree)
 
-	for k, v := range alphabet {
-		fmt.Printf("alphabet[%d]=%d\n", k, v)
+	alphabet, err := readCodeLengths(r, tree, int(hlit+hdist+258))
+	if err != nil {
+		return nil, nil, err
 	}
 
-	literalRoot := buildHuffmanTree(alphabet[:hlit+257])
-	distanceRoot := buildHuffmanTree(alphabet[hlit+257:])
+	// The codes span exactly the HLIT+257 and HDIST+1 declared symbols.
+	// Trailing zero lengths declare unused symbols, which get no code and so
+	// neither shift the codes of the others nor raise the maximum length.
+	if err := d.dynLiteral.init(alphabet[:hlit+257]); err != nil {
+		return nil, nil, err
+	}
+	if err := d.dynDistance.initDistance(alphabet[hlit+257:]); err != nil {
+		return nil, nil, err
+	}
 
-	// literalRoot.Print()
-	// log.Println("----")
-	// distanceRoot.Print()
-	// log.Println("----")
+	return &d.dynLiteral, &d.dynDistance, nil
+}
 
-	ela := []int{11, 13, 15, 17, 19, 23, 27, 31, 35, 43, 51, 59, 67, 83, 99, 115, 131, 163, 195, 227}
-	eda := []int{4, 6, 8, 12, 16, 24, 32, 48, 64, 96, 128, 192, 256, 384, 512, 768, 1024, 1536, 2048, 3072, 4096, 6144, 8192, 12288, 16384, 24576}
-	node := literalRoot
-	buf := make([]uint8, 1000000)
-	bufi := 0
-	stopCode := 0
-	for stopCode == 0 {
-		b, err := r.readBit()
+// readCodeLengths decodes total code lengths with the code length tree,
+// expanding the repeat codes 16, 17 and 18. The literal/length and distance
+// lengths form a single sequence, in which a repeat may cross from one into
+// the other but never past the end. A repeat past the end, or of the previous
+// length at the start, is ErrBadHuffman.
+func readCodeLengths(br *bitReader, tree *HuffmanTree, total int) ([]uint, error) {
+	lengths := make([]uint, total)
+	for i := 0; i < total; {
+		code, err := tree.decode(br)
 		if err != nil {
 			return nil, err
 		}
-		if b > 0 {
-			if node.one == nil {
-				return nil, errors.New("one can't be nil")
-			}
-			node = node.one
-		} else {
-			if node.zero == nil {
-				return nil, errors.New("zero can't be nil")
-			}
-			node = node.zero
+		if code < 16 {
+			lengths[i] = uint(code)
+			i++
+			continue
 		}
 
-		if node.zero == nil && node.one == nil {
-			if node.code >= 286 {
-				return nil, errors.New("code is too big")
-			} else if node.code < 256 {
-				buf[bufi] = uint8(node.code)
-				bufi++
-			} else if node.code == 256 {
-				stopCode = -1
-				break
-			} else if node.code > 256 {
-				var length int
-				if node.code < 265 {
-					length = node.code - 254
-				} else if node.code < 285 {
-					eb, err := r.readBits(uint((node.code - 261) / 4))
-					if err != nil {
-						return nil, err
-					}
-					length = int(eb) + ela[node.code-265]
-				} else {
-					length = 258
-				}
+		var repeat, length uint
+		switch code {
+		case 16:
+			repeat, err = br.readBits(2)
+			repeat += 3
+			if i == 0 {
+				return nil, ErrBadHuffman
+			}
+			length = lengths[i-1]
+		case 17:
+			repeat, err = br.readBits(3)
+			repeat += 3
+		case 18:
+			repeat, err = br.readBits(7)
+			repeat += 11
+		default:
+			return nil, fmt.Errorf("%w: code length symbol %d", ErrBadCode, code)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if i+int(repeat) > total {
+			return nil, ErrBadHuffman
+		}
+		for ; repeat > 0; repeat-- {
+			lengths[i] = length
+			i++
+		}
+	}
+	return lengths, nil
+}
 
-				if distanceRoot == nil {
-					panic("no distance Root")
-				}
+// inflate decodes the LZ77 symbols of a compressed block using the given
+// literal/length and distance codes until the end-of-block code. Symbols
+// that cannot appear in the data are ErrBadCode. Input ending before the
+// end-of-block code is io.ErrUnexpectedEOF, which the caller reports as an
+// eobError.
+func (d *decompressor) inflate(r *bitReader, literal, distance *huffmanDecoder, buf []byte, limit int) ([]byte, error) {
+	for len(buf) < limit {
+		code, err := literal.decode(r)
+		if err != nil {
+			return nil, err
+		}
 
-				node = distanceRoot
-				for node.zero != nil || node.one != nil {
-					b, err := r.readBit()
-					if err != nil {
-						return nil, err
-					}
-					if b > 0 {
-						node = node.one
-					} else {
-						node = node.zero
-					}
-				}
+		if code >= 286 {
+			return nil, fmt.Errorf("%w: literal/length symbol %d", ErrBadCode, code)
+		} else if code < 256 {
+			buf = append(buf, uint8(code))
+			if d.st != nil {
+				d.st.Literals++
+			}
+		} else if code == 256 {
+			d.block = blockNone
+			return buf, nil
+		} else if code > 256 {
+			lc := code - 257
+			eb, err := r.readBits(lengthExtra[lc])
+			if err != nil {
+				return nil, err
+			}
+			length := lengthBase[lc] + int(eb)
+			if d.st != nil {
+				d.st.Matches++
+				d.st.MatchBytes += int64(length)
+			}
 
-				dist := node.code
+			dcode, err := distance.decode(r)
+			if err != nil {
+				return nil, err
+			}
 
-				if dist > 3 {
-					eb, err := r.readBits(uint((dist - 2) / 2))
-					if err != nil {
-						return nil, err
-					}
-					dist = int(eb) + eda[dist-4]
-				}
-				fmt.Printf("dist=%d\n", dist)
-				bp := bufi - dist - 1
-				for length > 0 {
-					length--
-					buf[bufi] = uint8(buf[bp])
-					bufi++
-					bp++
-				}
+			// distance codes 30 and 31 can appear in the code but
+			// never in the data
+			if dcode >= len(distBase) {
+				return nil, fmt.Errorf("%w: distance symbol %d", ErrBadCode, dcode)
+			}
+			eb, err = r.readBits(distExtra[dcode])
+			if err != nil {
+				return nil, err
+			}
+			// a distance of 1 refers to the immediately preceding byte
+			dist := distBase[dcode] + int(eb)
+			// append one byte at a time so overlapping copies see
+			// the bytes they produce
+			bp := len(buf) - dist
+			if bp < 0 {
+				return nil, ErrBadDistance
+			}
+			for length > 0 {
+				length--
+				buf = append(buf, buf[bp])
+				bp++
 			}
-			//printBuffer(buf)
-			node = literalRoot
 		}
 	}
-
-	printBuffer(buf)
-	return []byte{}, errors.New("done")
-}
-
-func printBuffer(b []uint8) {
-	s := ""
-	for _, v := range b {
-		s += string(byte(uint8(v)))
-	}
-	log.Printf("buf: %s", s)
+	return buf, nil
 }
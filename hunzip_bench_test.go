@@ -0,0 +1,172 @@
+package hzip
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+)
+
+// benchFile is a gzip fixture with its decoded contents.
+type benchFile struct {
+	name string
+	gz   []byte
+	text []byte
+}
+
+// benchFiles returns the bundled fixtures and a larger generated one, from
+// the empty member up to a few megabytes.
+func benchFiles(b *testing.B) []benchFile {
+	text := fixture(b, "rfc1952.txt")
+	large := bytes.Repeat(text, 100)
+	return []benchFile{
+		{"empty", fixture(b, "empty.gz"), nil},
+		{"rfc1952", fixture(b, "rfc1952.txt.gz"), text},
+		{"large", gzipData(b, large, gzip.DefaultCompression), large},
+	}
+}
+
+func BenchmarkHeaderParse(b *testing.B) {
+	for _, f := range append(benchFiles(b), benchFile{"allflags", fixture(b, "allflags.gz"), nil}) {
+		b.Run(f.name, func(b *testing.B) {
+			rb, err := NewReaderBuilder(bytes.NewReader(f.gz))
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.SetBytes(rb.BytesRead())
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := NewReaderBuilder(bytes.NewReader(f.gz)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkDynamicBlockDecode inflates raw DEFLATE streams made only of
+// dynamic blocks, without the gzip framing and checksum.
+func BenchmarkDynamicBlockDecode(b *testing.B) {
+	for _, f := range benchFiles(b)[1:] {
+		b.Run(f.name, func(b *testing.B) {
+			raw := deflateData(b, f.text, 6)
+			b.SetBytes(int64(len(f.text)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := inflateAll(raw); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkDecodeFile(b *testing.B) {
+	for _, f := range benchFiles(b) {
+		b.Run(f.name, func(b *testing.B) {
+			b.SetBytes(int64(len(f.text)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := Decompress(f.gz); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// benchmarkReadBits reads fields of 1 to 16 bits from random input.
+func benchmarkReadBits(b *testing.B, read func(*bitReader, uint) (uint, error)) {
+	data := make([]byte, 1<<16)
+	rand.New(rand.NewSource(1)).Read(data)
+	var br bitReader
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		br.reset(bytes.NewReader(data))
+		for c := uint(1); ; c = c%16 + 1 {
+			if _, err := read(&br, c); err != nil {
+				break
+			}
+		}
+	}
+}
+
+func BenchmarkReadBits(b *testing.B) {
+	benchmarkReadBits(b, (*bitReader).readBits)
+}
+
+func BenchmarkReadBitsLoop(b *testing.B) {
+	benchmarkReadBits(b, readBitsLoop)
+}
+
+// BenchmarkBufferSize decodes from a source without ReadByte, which the
+// reader buffers with WithBufferSize.
+func BenchmarkBufferSize(b *testing.B) {
+	f := benchFiles(b)[2]
+	for _, n := range []int{512, 4096, 32 << 10, 64 << 10} {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			b.SetBytes(int64(len(f.text)))
+			for i := 0; i < b.N; i++ {
+				rb, err := NewReaderBuilder(plainReader{bytes.NewReader(f.gz)}, WithBufferSize(n))
+				if err != nil {
+					b.Fatal(err)
+				}
+				r, err := rb.Reader()
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := io.Copy(ioutil.Discard, r); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkWindowPool decodes many small messages, with windows taken from
+// windowPool and, for comparison, with the pool emptied after every message.
+func BenchmarkWindowPool(b *testing.B) {
+	data := gzipData(b, fixture(b, "rfc1952.txt")[:1000], gzip.DefaultCompression)
+	for _, pooled := range []bool{true, false} {
+		b.Run(fmt.Sprintf("pooled=%t", pooled), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := decodeAll(data); err != nil {
+					b.Fatal(err)
+				}
+				if !pooled {
+					windowPool.Get()
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkSizeHint compares Decompress, which allocates its output from the
+// ISIZE of the trailer, with reading the same stream into a growing buffer.
+func BenchmarkSizeHint(b *testing.B) {
+	f := benchFiles(b)[2]
+	b.Run("hint", func(b *testing.B) {
+		b.SetBytes(int64(len(f.text)))
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := Decompress(f.gz); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("grow", func(b *testing.B) {
+		b.SetBytes(int64(len(f.text)))
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := decodeAll(f.gz); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
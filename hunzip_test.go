@@ -0,0 +1,1742 @@
+package hzip
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+// fixture returns the contents of a file in the test directory.
+func fixture(tb testing.TB, name string) []byte {
+	tb.Helper()
+	b, err := ioutil.ReadFile(filepath.Join("test", name))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return b
+}
+
+// gzipData compresses data with compress/gzip at the given level.
+func gzipData(tb testing.TB, data []byte, level int) []byte {
+	tb.Helper()
+	var b bytes.Buffer
+	w, err := gzip.NewWriterLevel(&b, level)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		tb.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		tb.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+// decodeAll decodes a whole gzip stream through NewReaderBuilder.
+func decodeAll(data []byte, opts ...Option) ([]byte, error) {
+	rb, err := NewReaderBuilder(bytes.NewReader(data), opts...)
+	if err != nil {
+		return nil, err
+	}
+	r, err := rb.Reader()
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+func TestDecodeFixtures(t *testing.T) {
+	tests := []struct {
+		name string
+		gz   []byte
+		want []byte
+	}{
+		{"rfc1952", fixture(t, "rfc1952.txt.gz"), fixture(t, "rfc1952.txt")},
+		{"short", gzipData(t, []byte("hello, world\n"), gzip.DefaultCompression), []byte("hello, world\n")},
+		{"best", gzipData(t, fixture(t, "rfc1952.txt"), gzip.BestCompression), fixture(t, "rfc1952.txt")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeAll(tt.gz)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("decoded %d bytes, want %d bytes", len(got), len(tt.want))
+			}
+		})
+	}
+}
+
+// captureOutput returns what f writes to standard output and standard error.
+func captureOutput(t *testing.T, f func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, stderr := os.Stdout, os.Stderr
+	os.Stdout, os.Stderr = w, w
+	log.SetOutput(w)
+	defer func() {
+		os.Stdout, os.Stderr = stdout, stderr
+		log.SetOutput(os.Stderr)
+	}()
+	done := make(chan []byte)
+	go func() {
+		b, _ := ioutil.ReadAll(r)
+		done <- b
+	}()
+	f()
+	w.Close()
+	return string(<-done)
+}
+
+func TestDecodeIsSilent(t *testing.T) {
+	out := captureOutput(t, func() {
+		if _, err := decodeAll(fixture(t, "rfc1952.txt.gz")); err != nil {
+			t.Error(err)
+		}
+	})
+	if out != "" {
+		t.Errorf("decoding wrote %q", out)
+	}
+}
+
+func TestLogger(t *testing.T) {
+	var b bytes.Buffer
+	if _, err := decodeAll(fixture(t, "rfc1952.txt.gz"), WithLogger(log.New(&b, "", 0))); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(b.String(), "header:") || !strings.Contains(b.String(), "block:") {
+		t.Errorf("log is missing header or block messages:\n%s", b.String())
+	}
+}
+
+// plainReader hides every method of r but Read.
+type plainReader struct {
+	r io.Reader
+}
+
+func (p plainReader) Read(b []byte) (int, error) {
+	return p.r.Read(b)
+}
+
+func TestRemainingAfterFirstMember(t *testing.T) {
+	first := []byte("first member")
+	data := append(gzipData(t, first, 6), fixture(t, "allflags.gz")...)
+
+	rb, err := NewReaderBuilder(plainReader{bytes.NewReader(data)}, WithMultistream(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := rb.Reader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(r)
+	if err != nil || !bytes.Equal(got, first) {
+		t.Fatalf("first member = %q, %v", got, err)
+	}
+
+	rb2, err := NewReaderBuilder(rb.Remaining())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rb2.Name != "rfc1952-head.txt" {
+		t.Errorf("second member name = %q", rb2.Name)
+	}
+	r2, err := rb2.Reader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ioutil.ReadAll(r2); err != nil || len(got) != 4000 {
+		t.Errorf("second member: %d bytes, %v", len(got), err)
+	}
+}
+
+func TestDecompressInto(t *testing.T) {
+	text := fixture(t, "rfc1952.txt")
+	inputs := [][]byte{text[:100], text[:5000], nil, text[:3000], text}
+	dst := make([]byte, 0, 5000)
+	for _, in := range inputs {
+		data := gzipData(t, in, 6)
+		out, err := DecompressInto(dst, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out, in) {
+			t.Fatalf("decoded %d bytes, want %d", len(out), len(in))
+		}
+		fits := len(in) <= cap(dst)
+		if reused := &out[:1][0] == &dst[:1][0]; reused != fits {
+			t.Errorf("%d bytes: output in dst = %t, want %t", len(in), reused, fits)
+		}
+	}
+
+	out, err := DecompressInto(dst, gzipData(t, text, 6), WithFixedOutput())
+	if err != io.ErrShortBuffer {
+		t.Errorf("fixed output: error %v, want io.ErrShortBuffer", err)
+	}
+	if !bytes.Equal(out, text[:cap(dst)]) {
+		t.Errorf("fixed output: got %d bytes, want the first %d", len(out), cap(dst))
+	}
+	out, err = DecompressInto(dst, gzipData(t, text[:5000], 6), WithFixedOutput())
+	if err != nil || len(out) != 5000 {
+		t.Errorf("exact fit: %d bytes, %v", len(out), err)
+	}
+}
+
+func TestAllHeaderFlags(t *testing.T) {
+	data := fixture(t, "allflags.gz")
+	rb, err := NewReaderBuilder(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rb.Name != "rfc1952-head.txt" || rb.Comment != "all optional header fields set" || !rb.IsText {
+		t.Errorf("header: name %q, comment %q, text %t", rb.Name, rb.Comment, rb.IsText)
+	}
+	if rb.CRC16 != 0xb107 {
+		t.Errorf("CRC16 = %04x, want b107", rb.CRC16)
+	}
+	subs, err := rb.Subfields()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Subfield{{'A', 'P', []byte("abcdef")}, {'X', 'Y', []byte{1, 2, 3}}}
+	if len(subs) != len(want) {
+		t.Fatalf("%d subfields, want %d", len(subs), len(want))
+	}
+	for i, s := range subs {
+		if s.SI1 != want[i].SI1 || s.SI2 != want[i].SI2 || !bytes.Equal(s.Data, want[i].Data) {
+			t.Errorf("subfield %d = %c%c %x, want %c%c %x", i, s.SI1, s.SI2, s.Data, want[i].SI1, want[i].SI2, want[i].Data)
+		}
+	}
+	r, err := rb.Reader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ioutil.ReadAll(r); err != nil || !bytes.Equal(got, fixture(t, "rfc1952.txt")[:4000]) {
+		t.Errorf("body: %d bytes, %v", len(got), err)
+	}
+
+	// the header checksum covers the comment
+	bad := append([]byte(nil), data...)
+	i := bytes.Index(bad, []byte("optional"))
+	bad[i] = 'O'
+	if _, err := NewReaderBuilder(bytes.NewReader(bad)); err != ErrHeaderCRC {
+		t.Errorf("corrupt comment: error %v, want ErrHeaderCRC", err)
+	}
+}
+
+func TestDecompressEmpty(t *testing.T) {
+	for _, data := range [][]byte{fixture(t, "empty.gz"), gzipData(t, nil, gzip.DefaultCompression)} {
+		out, err := Decompress(data)
+		if err != nil || out == nil || len(out) != 0 {
+			t.Errorf("Decompress = %q (nil %t), %v; want empty, non-nil", out, out == nil, err)
+		}
+	}
+}
+
+// readBitsLoop is the bit-at-a-time readBits that the accumulator replaced.
+func readBitsLoop(br *bitReader, c uint) (uint, error) {
+	var v uint
+	for i := uint(0); i < c; i++ {
+		bit, err := br.readBit()
+		if err != nil {
+			return 0, err
+		}
+		v |= uint(bit) << i
+	}
+	return v, nil
+}
+
+func TestReadBitsMatchesReadBit(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	data := make([]byte, 4096)
+	rnd.Read(data)
+	fast, err := newBitReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	slow, err := newBitReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; ; i++ {
+		c := uint(rnd.Intn(16) + 1)
+		want, werr := readBitsLoop(slow, c)
+		got, err := fast.readBits(c)
+		if (err != nil) != (werr != nil) {
+			t.Fatalf("read %d: error %v, bit-at-a-time error %v", i, err, werr)
+		}
+		if err != nil {
+			break
+		}
+		if got != want {
+			t.Fatalf("read %d of %d bits = %x, want %x", i, c, got, want)
+		}
+	}
+}
+
+func TestBufferSize(t *testing.T) {
+	data := fixture(t, "rfc1952.txt.gz")
+	want := fixture(t, "rfc1952.txt")
+	for _, n := range []int{0, 1, 16, 4096, 1 << 16} {
+		rb, err := NewReaderBuilder(plainReader{bytes.NewReader(data)}, WithBufferSize(n))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := rb.Reader()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := ioutil.ReadAll(r); err != nil || !bytes.Equal(got, want) {
+			t.Errorf("buffer size %d: %d bytes, %v", n, len(got), err)
+		}
+	}
+}
+
+func TestSizeHint(t *testing.T) {
+	text := fixture(t, "rfc1952.txt")
+	data := gzipData(t, text, 6)
+	huge := append([]byte(nil), data...)
+	le.PutUint32(huge[len(huge)-4:], 0xffffffff)
+	tests := []struct {
+		name string
+		data []byte
+		want int
+	}{
+		{"exact", data, len(text)},
+		{"short", data[:7], 0},
+		{"multistream", append(gzipData(t, text[:10], 6), gzipData(t, text[:20], 6)...), 20},
+		{"capped", huge, len(huge) * maxRatio},
+	}
+	for _, tt := range tests {
+		if got := sizeHint(tt.data); got != tt.want {
+			t.Errorf("%s: sizeHint = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+// decodeStats decodes a gzip stream and returns its output with the
+// statistics of each member.
+func decodeStats(t *testing.T, data []byte) ([]byte, []Stats) {
+	t.Helper()
+	rb, err := NewReaderBuilder(bytes.NewReader(data), WithStats(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := rb.Reader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out, rb.Stats()
+}
+
+func TestStoredBlocks(t *testing.T) {
+	text := fixture(t, "rfc1952.txt")
+	out, stats := decodeStats(t, gzipData(t, text, gzip.NoCompression))
+	if !bytes.Equal(out, text) {
+		t.Errorf("decoded %d bytes, want %d", len(out), len(text))
+	}
+	// compress/flate ends the stream with an empty fixed block
+	if len(stats) != 1 || stats[0].StoredBlocks == 0 || stats[0].Literals+stats[0].Matches != 0 {
+		t.Errorf("stats %+v, want only stored data", stats)
+	}
+
+	tests := []struct {
+		name string
+		raw  []byte
+		want string
+		err  error
+	}{
+		{"hello", []byte{0x01, 5, 0, 0xfa, 0xff, 'h', 'e', 'l', 'l', 'o'}, "hello", nil},
+		{"empty", []byte{0x01, 0, 0, 0xff, 0xff}, "", nil},
+		{"bad NLEN", []byte{0x01, 5, 0, 0, 0, 'h', 'e', 'l', 'l', 'o'}, "", ErrBadStoredLength},
+		{"truncated", []byte{0x01, 5, 0, 0xfa, 0xff, 'h', 'e'}, "he", io.ErrUnexpectedEOF},
+	}
+	for _, tt := range tests {
+		got, err := inflateAll(tt.raw)
+		if !errors.Is(err, tt.err) || err == nil && tt.err != nil {
+			t.Errorf("%s: error %v, want %v", tt.name, err, tt.err)
+		}
+		if tt.err == nil && string(got) != tt.want {
+			t.Errorf("%s: decoded %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+// gzipMember frames a raw DEFLATE stream of text as a gzip member with a
+// minimal header.
+func gzipMember(raw, text []byte) []byte {
+	b := append([]byte{0x1f, 0x8b, 8, 0, 0, 0, 0, 0, 0, 255}, raw...)
+	var trailer [8]byte
+	le.PutUint32(trailer[0:4], CRC32(text))
+	le.PutUint32(trailer[4:8], uint32(len(text)))
+	return append(b, trailer[:]...)
+}
+
+func TestFixedBlocks(t *testing.T) {
+	// written by zlib with the Z_FIXED strategy
+	tests := []struct {
+		raw  string
+		text string
+	}{
+		{"\xcb\x48\xcd\xc9\xc9\x57\xc8\x40\x90\x5c\x00", "hello hello hello\n"},
+		{"\x4b\x4c\x24\x0e\x00\x00", strings.Repeat("a", 40)},
+		{"\x03\x00", ""},
+	}
+	for _, tt := range tests {
+		out, stats := decodeStats(t, gzipMember([]byte(tt.raw), []byte(tt.text)))
+		if string(out) != tt.text {
+			t.Errorf("decoded %q, want %q", out, tt.text)
+		}
+		if len(stats) != 1 || stats[0].FixedBlocks != 1 || stats[0].StoredBlocks+stats[0].DynamicBlocks != 0 {
+			t.Errorf("%q: stats %+v, want one fixed block", tt.text, stats)
+		}
+	}
+}
+
+// tamper returns a copy of data with the byte at i, counted from the end when
+// negative, XORed with x.
+func tamper(data []byte, i int, x byte) []byte {
+	b := append([]byte(nil), data...)
+	if i < 0 {
+		i += len(b)
+	}
+	b[i] ^= x
+	return b
+}
+
+func TestChecksum(t *testing.T) {
+	text := fixture(t, "rfc1952.txt")
+	data := gzipData(t, text, 6)
+	if _, err := decodeAll(data); err != nil {
+		t.Fatalf("matching trailer: %v", err)
+	}
+
+	_, err := decodeAll(tamper(data, -8, 0x01))
+	var cerr *ChecksumError
+	if !errors.As(err, &cerr) || !errors.Is(err, ErrChecksum) {
+		t.Fatalf("corrupt CRC32: error %v, want a *ChecksumError", err)
+	}
+	if want := CRC32(text); cerr.Computed != want || cerr.Expected != want^0x01 {
+		t.Errorf("expected %08x, computed %08x; want %08x, %08x", cerr.Expected, cerr.Computed, want^0x01, want)
+	}
+}
+
+func TestSize(t *testing.T) {
+	data := gzipData(t, fixture(t, "rfc1952.txt"), 6)
+	if _, err := decodeAll(data); err != nil {
+		t.Fatalf("matching ISIZE: %v", err)
+	}
+	for _, i := range []int{-4, -1} {
+		if _, err := decodeAll(tamper(data, i, 0x80)); !errors.Is(err, ErrSize) {
+			t.Errorf("ISIZE byte %d tampered: error %v, want ErrSize", i, err)
+		}
+	}
+}
+
+func TestMultistream(t *testing.T) {
+	a, b := []byte("first member\n"), []byte("second member\n")
+	data := append(gzipData(t, a, 6), gzipData(t, b, 9)...)
+	tests := []struct {
+		name string
+		opts []Option
+		want string
+	}{
+		{"default", nil, "first member\nsecond member\n"},
+		{"multistream", []Option{WithMultistream(true)}, "first member\nsecond member\n"},
+		{"single", []Option{WithMultistream(false)}, "first member\n"},
+	}
+	for _, tt := range tests {
+		got, err := decodeAll(data, tt.opts...)
+		if err != nil || string(got) != tt.want {
+			t.Errorf("%s: decoded %q, %v; want %q", tt.name, got, err, tt.want)
+		}
+	}
+
+	// a second member cut short is an error, not a clean end
+	if _, err := decodeAll(data[:len(data)-3]); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("truncated second member: error %v, want io.ErrUnexpectedEOF", err)
+	}
+}
+
+func TestLargeBlock(t *testing.T) {
+	text := bytes.Repeat([]byte("0123456789abcdef"), 1<<17)
+	out, stats := decodeStats(t, gzipData(t, text, gzip.BestCompression))
+	if !bytes.Equal(out, text) {
+		t.Fatalf("decoded %d bytes, want %d", len(out), len(text))
+	}
+	// all of the data is in one dynamic block, followed by the empty final
+	// block of compress/flate
+	if len(stats) != 1 || stats[0].DynamicBlocks != 1 {
+		t.Errorf("stats %+v, want a single dynamic block", stats)
+	}
+}
+
+func TestBackReferences(t *testing.T) {
+	rnd := rand.New(rand.NewSource(9))
+	random := func(n int) []byte {
+		b := make([]byte, n)
+		rnd.Read(b)
+		return b
+	}
+	head := random(100)
+	tests := []struct {
+		name string
+		text []byte
+	}{
+		{"distance 1", bytes.Repeat([]byte("a"), 300)},
+		{"distance 3", bytes.Repeat([]byte("abc"), 100)},
+		{"overlapping", append([]byte("xyzxyzxyzxy"), bytes.Repeat([]byte("zxy"), 200)...)},
+		{"repeated words", bytes.Repeat([]byte("the quick brown fox jumps over the lazy dog. "), 50)},
+		// the repeat of head is exactly 32768 bytes back
+		{"distance 32768", append(append(append([]byte(nil), head...), random(32768-100)...), head...)},
+	}
+	for _, tt := range tests {
+		for _, level := range []int{gzip.BestSpeed, gzip.BestCompression} {
+			got, err := decodeAll(gzipData(t, tt.text, level))
+			if err != nil || !bytes.Equal(got, tt.text) {
+				t.Errorf("%s, level %d: %d bytes, %v; want %d bytes", tt.name, level, len(got), err, len(tt.text))
+			}
+		}
+	}
+}
+
+func TestMatchesAcrossBlocks(t *testing.T) {
+	text := fixture(t, "rfc1952.txt")
+	var b bytes.Buffer
+	w := gzip.NewWriter(&b)
+	w.Write(text)
+	w.Flush()
+	n := b.Len()
+	// the second copy is a new block made of matches into the first
+	w.Write(text)
+	w.Close()
+	if b.Len()-n > 1000 {
+		t.Fatalf("second block is %d bytes; it does not refer back to the first", b.Len()-n)
+	}
+
+	out, stats := decodeStats(t, b.Bytes())
+	if want := append(append([]byte(nil), text...), text...); !bytes.Equal(out, want) {
+		t.Errorf("decoded %d bytes, want %d", len(out), len(want))
+	}
+	if len(stats) != 1 || stats[0].DynamicBlocks < 2 {
+		t.Errorf("stats %+v, want several dynamic blocks", stats)
+	}
+}
+
+// gzipHeader compresses data with compress/gzip using the given header.
+func gzipHeader(tb testing.TB, h gzip.Header, data []byte) []byte {
+	tb.Helper()
+	var b bytes.Buffer
+	w := gzip.NewWriter(&b)
+	w.Header = h
+	if _, err := w.Write(data); err != nil {
+		tb.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		tb.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestExtraField(t *testing.T) {
+	text := []byte("body after the extra field\n")
+	for _, extra := range [][]byte{
+		{},
+		{'A', 'B', 0, 0},
+		{'A', 'B', 8, 0, 1, 2, 3, 4, 5, 6, 7, 8},
+		append([]byte{'B', 'C', 0xfb, 0xff}, make([]byte, 0xfffb)...),
+	} {
+		rb, err := NewReaderBuilder(bytes.NewReader(gzipHeader(t, gzip.Header{Extra: extra, Name: "x"}, text)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(rb.Extra, extra) || rb.Name != "x" {
+			t.Errorf("%d-byte extra: read %d bytes, name %q", len(extra), len(rb.Extra), rb.Name)
+		}
+		r, err := rb.Reader()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := ioutil.ReadAll(r); err != nil || !bytes.Equal(got, text) {
+			t.Errorf("%d-byte extra: decoded %q, %v", len(extra), got, err)
+		}
+	}
+}
+
+func TestOneByteReads(t *testing.T) {
+	for _, name := range []string{"allflags.gz", "rfc1952.txt.gz", "empty.gz"} {
+		data := fixture(t, name)
+		want, err := decodeAll(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rb, err := NewReaderBuilder(iotest.OneByteReader(bytes.NewReader(data)))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		r, err := rb.Reader()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := ioutil.ReadAll(r); err != nil || !bytes.Equal(got, want) {
+			t.Errorf("%s: decoded %d bytes, %v; want %d", name, len(got), err, len(want))
+		}
+	}
+}
+
+func TestExtraSubfield(t *testing.T) {
+	extra := []byte{'A', 'P', 2, 0, 'h', 'i', 'B', 'C', 2, 0, 0x10, 0x27}
+	tests := []struct {
+		name     string
+		extra    []byte
+		si1, si2 byte
+		data     []byte
+		ok       bool
+		err      error
+	}{
+		{"first", extra, 'A', 'P', []byte("hi"), true, nil},
+		{"second", extra, 'B', 'C', []byte{0x10, 0x27}, true, nil},
+		{"missing", extra, 'X', 'Y', nil, false, nil},
+		{"no extra", nil, 'A', 'P', nil, false, nil},
+		{"truncated data", extra[:11], 'B', 'C', nil, false, ErrBadExtra},
+		{"truncated header", extra[:9], 'X', 'Y', nil, false, ErrBadExtra},
+	}
+	for _, tt := range tests {
+		h := Header{Extra: tt.extra}
+		data, ok, err := h.ExtraSubfield(tt.si1, tt.si2)
+		if !bytes.Equal(data, tt.data) || ok != tt.ok || err != tt.err {
+			t.Errorf("%s: ExtraSubfield = %x, %t, %v; want %x, %t, %v", tt.name, data, ok, err, tt.data, tt.ok, tt.err)
+		}
+	}
+}
+
+func TestReset(t *testing.T) {
+	files := []struct {
+		gz   []byte
+		name string
+		text []byte
+	}{
+		{fixture(t, "allflags.gz"), "rfc1952-head.txt", fixture(t, "rfc1952.txt")[:4000]},
+		{gzipData(t, []byte("second stream"), 6), "", []byte("second stream")},
+		{fixture(t, "rfc1952.txt.gz"), "rfc1952.txt", fixture(t, "rfc1952.txt")},
+	}
+	var rb *ReaderBuilder
+	for i, f := range files {
+		src := plainReader{bytes.NewReader(f.gz)}
+		var err error
+		if rb == nil {
+			rb, err = NewReaderBuilder(src)
+		} else {
+			err = rb.Reset(src)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rb.Name != f.name {
+			t.Errorf("stream %d: name %q, want %q", i, rb.Name, f.name)
+		}
+		// the second stream follows a header with every field set
+		if i == 1 && (rb.Comment != "" || rb.Extra != nil || rb.IsText) {
+			t.Errorf("stream %d: header fields left over: %+v", i, rb.Header)
+		}
+		r, err := rb.Reader()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := ioutil.ReadAll(r); err != nil || !bytes.Equal(got, f.text) {
+			t.Errorf("stream %d: decoded %d bytes, %v; want %d", i, len(got), err, len(f.text))
+		}
+	}
+}
+
+func TestDecompress(t *testing.T) {
+	data := fixture(t, "rfc1952.txt.gz")
+	out, err := Decompress(data)
+	if err != nil || !bytes.Equal(out, fixture(t, "rfc1952.txt")) {
+		t.Fatalf("Decompress: %d bytes, %v", len(out), err)
+	}
+	tests := []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{"no input", nil, ErrBadHeader},
+		{"truncated header", data[:5], ErrBadHeader},
+		{"not gzip", []byte("plain text, not gzip"), ErrBadHeader},
+		{"truncated body", data[:len(data)/2], io.ErrUnexpectedEOF},
+		{"truncated trailer", data[:len(data)-4], io.ErrUnexpectedEOF},
+		{"bad CRC32", tamper(data, -5, 0xff), ErrChecksum},
+		{"bad ISIZE", tamper(data, -2, 0x01), ErrSize},
+	}
+	for _, tt := range tests {
+		if _, err := Decompress(tt.data); !errors.Is(err, tt.err) {
+			t.Errorf("%s: error %v, want %v", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestTruncated(t *testing.T) {
+	data := fixture(t, "rfc1952.txt.gz")
+	// every cut past the fixed header lands in the name, body or trailer
+	for n := 10; n < len(data); n += 97 {
+		for _, cut := range []int{n, len(data) - 1 - n%8} {
+			_, err := decodeAll(data[:cut])
+			if !errors.Is(err, io.ErrUnexpectedEOF) {
+				t.Fatalf("cut at %d of %d: error %v, want io.ErrUnexpectedEOF", cut, len(data), err)
+			}
+		}
+	}
+	if _, err := decodeAll(data); err != nil {
+		t.Errorf("whole stream: %v", err)
+	}
+}
+
+func TestHeaderCRC(t *testing.T) {
+	var b bytes.Buffer
+	w := NewWriter(&b, WithHeaderCRC(true))
+	w.Name = "name.txt"
+	w.Write([]byte("payload"))
+	w.Close()
+	data := b.Bytes()
+	// the header is 10 fixed bytes, the name with its NUL and the CRC16
+	crc16 := 10 + len("name.txt") + 1
+
+	got, err := decodeAll(data)
+	if err != nil || string(got) != "payload" {
+		t.Fatalf("valid FHCRC: decoded %q, %v", got, err)
+	}
+	for _, i := range []int{4, 9, 12, crc16, crc16 + 1} {
+		if _, err := decodeAll(tamper(data, i, 0x20)); err != ErrHeaderCRC {
+			t.Errorf("header byte %d flipped: error %v, want ErrHeaderCRC", i, err)
+		}
+	}
+}
+
+func TestBytesRead(t *testing.T) {
+	for _, name := range []string{"rfc1952.txt.gz", "allflags.gz", "empty.gz"} {
+		member := fixture(t, name)
+		data := append(append([]byte(nil), member...), "trailing archive data"...)
+		for _, src := range []io.Reader{bytes.NewReader(data), plainReader{bytes.NewReader(data)}} {
+			rb, err := NewReaderBuilder(src, WithMultistream(false))
+			if err != nil {
+				t.Fatal(err)
+			}
+			r, err := rb.Reader()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := io.Copy(ioutil.Discard, r); err != nil {
+				t.Fatal(err)
+			}
+			if n := rb.BytesRead(); n != int64(len(member)) {
+				t.Errorf("%s from %T: BytesRead = %d, want %d", name, src, n, len(member))
+			}
+		}
+	}
+}
+
+func TestReaderWithContext(t *testing.T) {
+	const size = 16 << 20
+	data := gzipData(t, make([]byte, size), gzip.BestSpeed)
+	rb, err := NewReaderBuilder(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	r, err := rb.ReaderWithContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(r, make([]byte, 1<<20)); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	n, err := io.Copy(ioutil.Discard, r)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("after cancel: error %v, want context.Canceled", err)
+	}
+	if n > size/2 {
+		t.Errorf("decoded %d more bytes after cancel", n)
+	}
+
+	rb, err = NewReaderBuilder(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err = rb.ReaderWithContext(ctx)
+	if err == nil {
+		_, err = r.Read(make([]byte, 1))
+	}
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("canceled before reading: error %v, want context.Canceled", err)
+	}
+}
+
+func TestMaxOutputSize(t *testing.T) {
+	const size = 4 << 20
+	for _, level := range []int{gzip.NoCompression, gzip.BestSpeed, gzip.HuffmanOnly, gzip.BestCompression} {
+		data := gzipData(t, make([]byte, size), level)
+		for _, limit := range []int64{1, 1 << 20, size - 1, size, size + 1, 0} {
+			rb, err := NewReaderBuilder(bytes.NewReader(data), WithMaxOutputSize(limit))
+			if err != nil {
+				t.Fatal(err)
+			}
+			r, err := rb.Reader()
+			if err != nil {
+				t.Fatal(err)
+			}
+			n, err := io.Copy(ioutil.Discard, r)
+			if limit == 0 || limit >= size {
+				if err != nil || n != size {
+					t.Errorf("level %d, limit %d: %d bytes, %v", level, limit, n, err)
+				}
+				continue
+			}
+			if err != ErrOutputLimit || n != limit {
+				t.Errorf("level %d, limit %d: %d bytes, %v; want %d bytes and ErrOutputLimit", level, limit, n, err, limit)
+			}
+		}
+	}
+}
+
+func TestOSName(t *testing.T) {
+	tests := []struct {
+		os   byte
+		want string
+	}{
+		{0, "FAT filesystem"},
+		{1, "Amiga"},
+		{2, "VMS"},
+		{3, "Unix"},
+		{4, "VM/CMS"},
+		{5, "Atari TOS"},
+		{6, "HPFS filesystem"},
+		{7, "Macintosh"},
+		{8, "Z-System"},
+		{9, "CP/M"},
+		{10, "TOPS-20"},
+		{11, "NTFS filesystem"},
+		{12, "QDOS"},
+		{13, "Acorn RISCOS"},
+		{14, "unknown"},
+		{100, "unknown"},
+		{255, "unknown"},
+	}
+	for _, tt := range tests {
+		h := Header{OS: tt.os}
+		if got := h.OSName(); got != tt.want {
+			t.Errorf("OSName(%d) = %q, want %q", tt.os, got, tt.want)
+		}
+	}
+}
+
+// writeHeader compresses data with a Writer using the given header.
+func writeHeader(tb testing.TB, h Header, data []byte) []byte {
+	tb.Helper()
+	var b bytes.Buffer
+	w := NewWriter(&b)
+	w.Header = h
+	if _, err := w.Write(data); err != nil {
+		tb.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		tb.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestIsText(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want bool
+	}{
+		{"allflags.gz", fixture(t, "allflags.gz"), true},
+		{"rfc1952.txt.gz", fixture(t, "rfc1952.txt.gz"), false},
+		{"Writer text", writeHeader(t, Header{IsText: true}, []byte("text\n")), true},
+		{"Writer binary", writeHeader(t, Header{}, []byte{0, 1, 2}), false},
+	}
+	for _, tt := range tests {
+		rb, err := NewReaderBuilder(bytes.NewReader(tt.data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rb.IsText != tt.want {
+			t.Errorf("%s: IsText = %t, want %t", tt.name, rb.IsText, tt.want)
+		}
+		if ftext := tt.data[3]&FTEXT != 0; ftext != tt.want {
+			t.Errorf("%s: FTEXT bit = %t, want %t", tt.name, ftext, tt.want)
+		}
+	}
+}
+
+func TestModTime(t *testing.T) {
+	known := time.Date(2019, 5, 25, 21, 2, 18, 0, time.UTC)
+	tests := []struct {
+		name string
+		data []byte
+		want time.Time
+	}{
+		{"MTIME 0", writeHeader(t, Header{}, nil), time.Time{}},
+		{"known MTIME", writeHeader(t, Header{ModTime: known}, nil), known},
+		{"allflags.gz", fixture(t, "allflags.gz"), known},
+		{"MTIME 1", writeHeader(t, Header{ModTime: time.Unix(1, 0)}, nil), time.Unix(1, 0)},
+	}
+	for _, tt := range tests {
+		rb, err := NewReaderBuilder(bytes.NewReader(tt.data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !rb.ModTime.Equal(tt.want) || rb.HasModTime() != !tt.want.IsZero() {
+			t.Errorf("%s: ModTime %v, HasModTime %t; want %v", tt.name, rb.ModTime, rb.HasModTime(), tt.want)
+		}
+		if rb.HasModTime() && rb.ModTime.Location() != time.UTC {
+			t.Errorf("%s: ModTime in %v, want UTC", tt.name, rb.ModTime.Location())
+		}
+	}
+}
+
+// fixedBlock writes tokens as a final fixed Huffman block.
+func fixedBlock(tokens []token) []byte {
+	var b bytes.Buffer
+	bw := newBitWriter(&b)
+	writeFixedBlock(bw, tokens, true)
+	bw.align()
+	bw.flush()
+	return b.Bytes()
+}
+
+// distanceLengths returns complete distance code lengths for all 30 symbols.
+func distanceLengths() []uint {
+	dist := make([]uint, 30)
+	for i := range dist {
+		dist[i] = 5
+	}
+	dist[0], dist[1] = 4, 4
+	return dist
+}
+
+// checkTokens decodes tokens from a fixed and from a dynamic block and
+// compares the output with what they encode.
+func checkTokens(t *testing.T, name string, tokens []token) {
+	t.Helper()
+	want := replay(t, nil, tokens)
+	for _, raw := range [][]byte{fixedBlock(tokens), dynamicBlock(literalLengths(), distanceLengths(), tokens)} {
+		got, err := inflateAll(raw)
+		if err != nil || !bytes.Equal(got, want) {
+			t.Errorf("%s: decoded %d bytes, %v; want %d", name, len(got), err, len(want))
+		}
+	}
+}
+
+func TestLengthCodes(t *testing.T) {
+	var lits []token
+	for _, c := range []byte("0123456789") {
+		lits = append(lits, literalToken(c))
+	}
+	// every length, so every length code and all of its extra bits
+	all := append([]token(nil), lits...)
+	for n := minMatch; n <= maxMatch; n++ {
+		all = append(all, matchToken(n, 10))
+	}
+	checkTokens(t, "all lengths", all)
+	for _, n := range []int{3, 10, 11, 12, 13, 18, 19, 226, 227, 257, 258} {
+		checkTokens(t, fmt.Sprintf("length %d, code %d", n, 257+lengthCode(n)), append(append([]token(nil), lits...), matchToken(n, 10)))
+	}
+}
+
+func TestDistanceCodes(t *testing.T) {
+	prefix := make([]byte, windowSize)
+	rand.New(rand.NewSource(43)).Read(prefix)
+	var lits []token
+	for _, c := range prefix {
+		lits = append(lits, literalToken(c))
+	}
+	for _, d := range []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 100, 1024, 1025, 16384, 24576, 24577, 32767, 32768} {
+		checkTokens(t, fmt.Sprintf("distance %d, code %d", d, distCode(d)), append(append([]token(nil), lits...), matchToken(3, d), matchToken(258, d)))
+	}
+
+	// the fixed code has 5-bit codes for the distance symbols 30 and 31,
+	// which do not exist
+	for _, sym := range []int{30, 31} {
+		var b bytes.Buffer
+		bw := newBitWriter(&b)
+		writeBlockHeader(bw, 1, true)
+		lit, _ := fixedHuffmanEncoders()
+		lit.write(bw, 'a')
+		lit.write(bw, 257)
+		bw.writeBits(uint32(reverseBits(sym, 5)), 5)
+		lit.write(bw, 256)
+		bw.align()
+		bw.flush()
+		if _, err := inflateAll(b.Bytes()); !errors.Is(err, ErrBadCode) {
+			t.Errorf("distance symbol %d: error %v, want ErrBadCode", sym, err)
+		}
+	}
+}
+
+func TestDistanceTooFar(t *testing.T) {
+	a, b := literalToken('a'), literalToken('b')
+	tests := []struct {
+		name   string
+		tokens []token
+	}{
+		{"before any output", []token{matchToken(3, 1)}},
+		{"one past the start", []token{a, b, matchToken(3, 3)}},
+		{"past the window", []token{a, matchToken(258, 1), matchToken(3, 32768)}},
+	}
+	for _, tt := range tests {
+		for _, raw := range [][]byte{fixedBlock(tt.tokens), dynamicBlock(literalLengths(), distanceLengths(), tt.tokens)} {
+			if _, err := inflateAll(raw); err != ErrBadDistance {
+				t.Errorf("%s: error %v, want ErrBadDistance", tt.name, err)
+			}
+			if _, err := decodeAll(gzipMember(raw, nil)); err != ErrBadDistance {
+				t.Errorf("%s in a gzip member: error %v, want ErrBadDistance", tt.name, err)
+			}
+		}
+	}
+}
+
+func TestUnsupportedMethod(t *testing.T) {
+	data := fixture(t, "rfc1952.txt.gz")
+	for _, cm := range []byte{0, 7, 9, 255} {
+		bad := append([]byte(nil), data...)
+		bad[2] = cm
+		_, err := NewReaderBuilder(bytes.NewReader(bad))
+		var merr *MethodError
+		if !errors.As(err, &merr) || merr.Method != cm || !errors.Is(err, ErrUnsupportedMethod) {
+			t.Errorf("CM %d: error %v, want a *MethodError for %d", cm, err, cm)
+		}
+	}
+}
+
+func TestErrorWrapping(t *testing.T) {
+	data := fixture(t, "rfc1952.txt.gz")
+	errSource := errors.New("source failed")
+	tests := []struct {
+		name   string
+		src    io.Reader
+		errors []error
+	}{
+		{"empty", bytes.NewReader(nil), []error{ErrBadHeader, io.EOF}},
+		{"short header", bytes.NewReader(data[:4]), []error{ErrBadHeader, io.ErrUnexpectedEOF}},
+		{"short name", bytes.NewReader(data[:12]), []error{ErrBadHeader, io.ErrUnexpectedEOF}},
+		{"source error in header", iotest.ErrReader(errSource), []error{ErrBadHeader, errSource}},
+		{"source error in body", io.MultiReader(bytes.NewReader(data[:100]), iotest.ErrReader(errSource)), []error{errSource}},
+		{"short body", bytes.NewReader(data[:100]), []error{io.ErrUnexpectedEOF}},
+	}
+	for _, tt := range tests {
+		var err error
+		if rb, berr := NewReaderBuilder(tt.src); berr != nil {
+			err = berr
+		} else if r, rerr := rb.Reader(); rerr != nil {
+			err = rerr
+		} else {
+			_, err = ioutil.ReadAll(r)
+		}
+		for _, target := range tt.errors {
+			if !errors.Is(err, target) {
+				t.Errorf("%s: error %v does not match %v", tt.name, err, target)
+			}
+		}
+		if !strings.HasPrefix(fmt.Sprint(err), "hunzip: ") {
+			t.Errorf("%s: error %q lacks the package prefix", tt.name, err)
+		}
+	}
+
+	_, err := NewReaderBuilder(bytes.NewReader(data[:4]))
+	var herr *HeaderError
+	if !errors.As(err, &herr) || herr.Err != io.ErrUnexpectedEOF {
+		t.Errorf("short header: error %v, want a *HeaderError", err)
+	}
+}
+
+func TestNewReader(t *testing.T) {
+	r, err := NewReader(bytes.NewReader(fixture(t, "rfc1952.txt.gz")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(r)
+	if err != nil || !bytes.Equal(got, fixture(t, "rfc1952.txt")) {
+		t.Errorf("decoded %d bytes, %v", len(got), err)
+	}
+	if err := r.Close(); err != nil {
+		t.Errorf("Close: %v", err)
+	}
+	if _, err := NewReader(strings.NewReader("not gzip")); !errors.Is(err, ErrBadHeader) {
+		t.Errorf("bad header: error %v, want ErrBadHeader", err)
+	}
+}
+
+func TestHeaderOnly(t *testing.T) {
+	for _, data := range [][]byte{
+		gzipData(t, nil, gzip.DefaultCompression)[:10],
+		// the fixed header and the name "empty"
+		fixture(t, "empty.gz")[:16],
+	} {
+		rb, err := NewReaderBuilder(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("header: %v", err)
+		}
+		r, err := rb.Reader()
+		if err == nil {
+			_, err = ioutil.ReadAll(r)
+		}
+		if !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("%d-byte header without a body: error %v, want io.ErrUnexpectedEOF", len(data), err)
+		}
+	}
+	if _, err := newBitReader(bytes.NewReader(nil)); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("newBitReader on no input: error %v, want io.ErrUnexpectedEOF", err)
+	}
+}
+
+// bgzfMember compresses data into a BGZF-style member: its extra field is a
+// BC subfield holding the member size minus one.
+func bgzfMember(tb testing.TB, data []byte) []byte {
+	tb.Helper()
+	b := writeHeader(tb, Header{Extra: []byte{'B', 'C', 2, 0, 0, 0}}, data)
+	le.PutUint16(b[16:18], uint16(len(b)-1))
+	return b
+}
+
+func TestBGZFBlockSize(t *testing.T) {
+	data := bgzfMember(t, []byte("a BGZF block"))
+	rb, err := NewReaderBuilder(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, ok := rb.BGZFBlockSize(); !ok || n != len(data) {
+		t.Errorf("BGZFBlockSize = %d, %t; want %d, true", n, ok, len(data))
+	}
+
+	for _, extra := range [][]byte{
+		nil,
+		{'A', 'B', 2, 0, 1, 2},
+		{'B', 'C', 3, 0, 1, 2, 3},
+		{'B', 'C', 2, 0, 1},
+	} {
+		h := Header{Extra: extra}
+		if n, ok := h.BGZFBlockSize(); ok {
+			t.Errorf("extra %x: BGZFBlockSize = %d, true; want false", extra, n)
+		}
+	}
+	h := Header{Extra: []byte{'A', 'B', 1, 0, 9, 'B', 'C', 2, 0, 0xff, 0xff}}
+	if n, ok := h.BGZFBlockSize(); !ok || n != 0x10000 {
+		t.Errorf("BC after another subfield: %d, %t; want 65536, true", n, ok)
+	}
+}
+
+func TestRawCapture(t *testing.T) {
+	two := append(fixture(t, "allflags.gz"), fixture(t, "rfc1952.txt.gz")...)
+	for _, data := range [][]byte{fixture(t, "rfc1952.txt.gz"), fixture(t, "empty.gz"), two} {
+		for _, src := range []io.Reader{bytes.NewReader(data), plainReader{bytes.NewReader(data)}} {
+			var raw bytes.Buffer
+			rb, err := NewReaderBuilder(src, WithRawCapture(&raw))
+			if err != nil {
+				t.Fatal(err)
+			}
+			r, err := rb.Reader()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := io.Copy(ioutil.Discard, r); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(raw.Bytes(), data) {
+				t.Errorf("%T: captured %d bytes of %d", src, raw.Len(), len(data))
+			}
+		}
+	}
+}
+
+func TestTruncatedDynamicHeader(t *testing.T) {
+	raw := deflateData(t, fixture(t, "rfc1952.txt"), 6)
+	if btype := raw[0] >> 1 & 3; btype != 2 {
+		t.Fatalf("first block type %d, want dynamic", btype)
+	}
+	// 3 bits of block header, then HLIT, HDIST and HCLEN end at bit 17, and
+	// the code length code lengths by bit 74
+	for n := 1; n <= 10; n++ {
+		if _, err := inflateAll(raw[:n]); !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("cut after %d bytes: error %v, want io.ErrUnexpectedEOF", n, err)
+		}
+	}
+
+	br, err := newBitReader(bytes.NewReader([]byte{0xff}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := br.readBits(3); err != nil || v != 7 {
+		t.Fatalf("readBits(3) = %d, %v", v, err)
+	}
+	if v, err := br.readBits(9); !errors.Is(err, io.ErrUnexpectedEOF) || v != 0 {
+		t.Errorf("readBits(9) past the end = %d, %v; want io.ErrUnexpectedEOF", v, err)
+	}
+	if v, err := br.readBits(5); err != nil || v != 31 {
+		t.Errorf("the bits left after a failed read = %d, %v; want 31", v, err)
+	}
+}
+
+func TestBitReaderAlign(t *testing.T) {
+	br, err := newBitReader(bytes.NewReader([]byte{0xb5, 0xab, 0xcd, 0xef, 0x12, 0x34, 0x56, 0x78, 0x9a}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := func(what string, got, want uint, err error) {
+		t.Helper()
+		if err != nil || got != want {
+			t.Fatalf("%s = %#x, %v; want %#x", what, got, err, want)
+		}
+	}
+	v, err := br.readBits(3)
+	check("readBits(3)", v, 0x5, err)
+	br.align()
+	b, err := br.readByte()
+	check("readByte after align", uint(b), 0xab, err)
+	v, err = br.readBits(12)
+	check("readBits(12)", v, 0xfcd, err)
+	br.align()
+	bs, err := br.readBytes(2)
+	if err != nil || !bytes.Equal(bs, []byte{0x12, 0x34}) {
+		t.Fatalf("readBytes(2) = %x, %v", bs, err)
+	}
+	// aligning an aligned reader discards nothing
+	br.align()
+	v, err = br.readBits(4)
+	check("readBits(4)", v, 0x6, err)
+	v, err = br.readBits(4)
+	check("readBits(4)", v, 0x5, err)
+	u, err := br.readUint32()
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("readUint32 with 2 bytes left: %#x, %v; want io.ErrUnexpectedEOF", u, err)
+	}
+
+	br, err = newBitReader(bytes.NewReader([]byte{0xf0, 0x78, 0x56, 0x34, 0x12}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err = br.readBits(4)
+	check("readBits(4)", v, 0x0, err)
+	br.align()
+	u, err = br.readUint32()
+	check("readUint32 after align", uint(u), 0x12345678, err)
+}
+
+func TestBitReaderReset(t *testing.T) {
+	br, err := newBitReader(bytes.NewReader([]byte{0x0f, 0xff}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := br.readBits(4); err != nil || v != 0xf {
+		t.Fatalf("first source: readBits(4) = %#x, %v", v, err)
+	}
+	// the 12 bits left of the first source are discarded
+	if err := br.reset(bytes.NewReader([]byte{0x34, 0x12})); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := br.readBits(16); err != nil || v != 0x1234 {
+		t.Errorf("second source: readBits(16) = %#x, %v; want 0x1234", v, err)
+	}
+	if _, err := br.readBits(1); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("past the second source: error %v, want io.ErrUnexpectedEOF", err)
+	}
+	// as with newBitReader, a source with no bytes fails at once
+	if err := br.reset(bytes.NewReader(nil)); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("reset to an empty source: error %v, want io.ErrUnexpectedEOF", err)
+	}
+}
+
+func TestTrailingGarbage(t *testing.T) {
+	data := fixture(t, "rfc1952.txt.gz")
+	want := fixture(t, "rfc1952.txt")
+	tests := []struct {
+		name     string
+		trailing string
+		err      error
+	}{
+		{"NUL", "\x00", nil},
+		{"NUL padding", "\x00\x00\x00\x00", nil},
+		{"text", "not a member", nil},
+		{"first magic byte", "\x1f", ErrBadHeader},
+		{"partial header", "\x1f\x8b\x08\x00", ErrBadHeader},
+		{"bad second magic byte", "\x1f\x00\x08\x00\x00\x00\x00\x00\x00\xff", ErrBadHeader},
+	}
+	for _, tt := range tests {
+		got, err := decodeAll(append(append([]byte(nil), data...), tt.trailing...))
+		if tt.err == nil && (err != nil || !bytes.Equal(got, want)) {
+			t.Errorf("%s: decoded %d bytes, %v; want %d and no error", tt.name, len(got), err, len(want))
+		}
+		if tt.err != nil && !errors.Is(err, tt.err) {
+			t.Errorf("%s: error %v, want %v", tt.name, err, tt.err)
+		}
+	}
+}
+
+// codeLengthSymbols encodes code length symbols, each with its extra bits,
+// with a complete code over all 19 symbols, and returns a reader of them and
+// the tree of that code.
+func codeLengthSymbols(t *testing.T, syms ...[2]uint) (*bitReader, *HuffmanTree) {
+	t.Helper()
+	clens := make([]uint, 19)
+	for i := range clens {
+		clens[i] = 4
+		if i >= 13 {
+			clens[i] = 5
+		}
+	}
+	enc := newHuffmanEncoderLengths(clens)
+	var b bytes.Buffer
+	bw := newBitWriter(&b)
+	for _, s := range syms {
+		enc.write(bw, int(s[0]))
+		switch s[0] {
+		case 16:
+			bw.writeBits(uint32(s[1]), 2)
+		case 17:
+			bw.writeBits(uint32(s[1]), 3)
+		case 18:
+			bw.writeBits(uint32(s[1]), 7)
+		}
+	}
+	bw.align()
+	bw.flush()
+	br, err := newBitReader(bytes.NewReader(b.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree, _ := buildHuffmanTree(clens, nil)
+	return br, tree
+}
+
+func TestReadCodeLengths(t *testing.T) {
+	rep := func(n int, l uint) []uint {
+		r := make([]uint, n)
+		for i := range r {
+			r[i] = l
+		}
+		return r
+	}
+	tests := []struct {
+		name  string
+		syms  [][2]uint
+		total int
+		want  []uint
+		err   error
+	}{
+		{"lengths", [][2]uint{{1, 0}, {15, 0}, {0, 0}, {7, 0}}, 4, []uint{1, 15, 0, 7}, nil},
+		{"16, 3 times", [][2]uint{{5, 0}, {16, 0}}, 4, rep(4, 5), nil},
+		{"16, 6 times", [][2]uint{{5, 0}, {16, 3}, {2, 0}}, 8, append(rep(7, 5), 2), nil},
+		{"17, 3 zeros", [][2]uint{{17, 0}, {9, 0}}, 4, []uint{0, 0, 0, 9}, nil},
+		{"17, 10 zeros", [][2]uint{{17, 7}}, 10, rep(10, 0), nil},
+		{"18, 11 zeros", [][2]uint{{3, 0}, {18, 0}}, 12, append([]uint{3}, rep(11, 0)...), nil},
+		{"18, 138 zeros", [][2]uint{{18, 127}, {4, 0}}, 139, append(rep(138, 0), 4), nil},
+		{"18 past the end", [][2]uint{{1, 0}, {18, 0}}, 11, nil, ErrBadHuffman},
+		{"truncated", [][2]uint{{1, 0}}, 10, nil, io.ErrUnexpectedEOF},
+	}
+	for _, tt := range tests {
+		br, tree := codeLengthSymbols(t, tt.syms...)
+		got, err := readCodeLengths(br, tree, tt.total)
+		if !errors.Is(err, tt.err) || (err != nil) != (tt.err != nil) {
+			t.Errorf("%s: error %v, want %v", tt.name, err, tt.err)
+			continue
+		}
+		if err == nil && fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("%s: lengths %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// rleBlock writes the header of a final dynamic block of nlit literal/length
+// and ndist distance codes whose code lengths are given by rle, in the form
+// rleCodeLengths returns, followed by no data.
+func rleBlock(nlit, ndist int, rle []int) []byte {
+	var clFreq [19]int
+	for _, c := range rle {
+		clFreq[c&0xff]++
+	}
+	h := &dynamicHeader{
+		cl:    newHuffmanEncoder(clFreq[:], 7),
+		nlit:  nlit,
+		ndist: ndist,
+		nclen: len(codeLengthOrder),
+		rle:   rle,
+	}
+	var b bytes.Buffer
+	bw := newBitWriter(&b)
+	h.write(bw, true)
+	bw.writeBits(0, 16)
+	bw.align()
+	bw.flush()
+	return b.Bytes()
+}
+
+func TestCodeLengthRepeatBounds(t *testing.T) {
+	valid := rleCodeLengths(append(literalLengths(), 1, 1))
+	// replaceLast returns valid with its last entry, the length of the
+	// last distance code, replaced by a repeat code
+	replaceLast := func(c int) []int {
+		return append(append([]int(nil), valid[:len(valid)-1]...), c)
+	}
+	tests := []struct {
+		name string
+		rle  []int
+	}{
+		{"16 first", append([]int{16}, valid...)},
+		{"16 past the end", replaceLast(16 | 3<<8)},
+		{"17 past the end", replaceLast(17 | 7<<8)},
+		{"18 past the end", replaceLast(18 | 127<<8)},
+	}
+	for _, tt := range tests {
+		if _, err := inflateAll(rleBlock(286, 2, tt.rle)); !errors.Is(err, ErrBadHuffman) {
+			t.Errorf("%s: error %v, want ErrBadHuffman", tt.name, err)
+		}
+	}
+	if _, err := inflateAll(rleBlock(286, 2, valid)); errors.Is(err, ErrBadHuffman) {
+		t.Errorf("valid lengths: %v", err)
+	}
+}
+
+func TestSubfields(t *testing.T) {
+	tests := []struct {
+		name  string
+		extra []byte
+		want  string
+		err   error
+	}{
+		{"none", nil, "[]", nil},
+		{"two", []byte{'A', 'P', 3, 0, 1, 2, 3, 'B', 'C', 2, 0, 0x10, 0x27}, "[AP:010203 BC:1027]", nil},
+		{"empty data", []byte{'Z', 'Z', 0, 0, 'A', 'B', 1, 0, 9}, "[ZZ: AB:09]", nil},
+		{"overrun", []byte{'A', 'P', 3, 0, 1, 2, 3, 'B', 'C', 9, 0, 0x10}, "", ErrBadExtra},
+		{"short subfield header", []byte{'A', 'P', 0, 0, 'B', 'C', 2}, "", ErrBadExtra},
+	}
+	for _, tt := range tests {
+		h := Header{Extra: tt.extra}
+		subs, err := h.Subfields()
+		if err != tt.err {
+			t.Errorf("%s: error %v, want %v", tt.name, err, tt.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		var got []string
+		for _, s := range subs {
+			got = append(got, fmt.Sprintf("%c%c:%x", s.SI1, s.SI2, s.Data))
+		}
+		if fmt.Sprint(got) != tt.want {
+			t.Errorf("%s: subfields %v, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSkipMember(t *testing.T) {
+	text := fixture(t, "rfc1952.txt")
+	// the body of the BGZF member is corrupted, which skipping it by its
+	// block size never notices
+	members := [][]byte{
+		writeHeader(t, Header{Name: "first"}, text[:5000]),
+		tamper(bgzfMember(t, text[5000:10000]), 30, 0xff),
+		writeHeader(t, Header{Comment: "third"}, text[10000:]),
+	}
+	file := bytes.Join(members, nil)
+	r := bytes.NewReader(file)
+
+	var off int64
+	for i, m := range members {
+		h, err := SkipMember(r)
+		if err != nil {
+			t.Fatalf("member %d: %v", i, err)
+		}
+		off += int64(len(m))
+		if pos, _ := r.Seek(0, io.SeekCurrent); pos != off {
+			t.Errorf("member %d: left at offset %d, want %d", i, pos, off)
+		}
+		switch i {
+		case 0:
+			if h.Name != "first" {
+				t.Errorf("member 0: name %q", h.Name)
+			}
+		case 1:
+			if n, ok := h.BGZFBlockSize(); !ok || n != len(m) {
+				t.Errorf("member 1: BGZFBlockSize = %d, %t", n, ok)
+			}
+		case 2:
+			if h.Comment != "third" {
+				t.Errorf("member 2: comment %q", h.Comment)
+			}
+		}
+	}
+	if _, err := SkipMember(r); err != io.EOF {
+		t.Errorf("at the end: error %v, want io.EOF", err)
+	}
+
+	// a plain member is decoded to find its end, so its errors show
+	r = bytes.NewReader(tamper(members[0], -8, 0xff))
+	if _, err := SkipMember(r); !errors.Is(err, ErrChecksum) {
+		t.Errorf("bad member: error %v, want ErrChecksum", err)
+	}
+}
+
+func TestStrict(t *testing.T) {
+	text := []byte("strict headers")
+	good := gzipData(t, text, gzip.BestCompression)
+	tests := []struct {
+		name string
+		data []byte
+		ok   bool
+	}{
+		{"valid", good, true},
+		{"reserved bit 5", tamper(good, 3, 0x20), false},
+		{"reserved bit 7", tamper(good, 3, 0x80), false},
+		{"XFL 4", tamper(good, 8, 2^4), true},
+		{"XFL 0", tamper(good, 8, 2), true},
+		{"XFL 3", tamper(good, 8, 2^3), false},
+	}
+	for _, tt := range tests {
+		// the lenient default decodes all of them
+		if got, err := decodeAll(tt.data); err != nil || !bytes.Equal(got, text) {
+			t.Errorf("%s: lenient decode: %q, %v", tt.name, got, err)
+		}
+		_, err := NewReaderBuilder(bytes.NewReader(tt.data), WithStrict())
+		if tt.ok && err != nil {
+			t.Errorf("%s: strict error %v", tt.name, err)
+		}
+		if !tt.ok && !errors.Is(err, ErrBadHeader) {
+			t.Errorf("%s: strict error %v, want ErrBadHeader", tt.name, err)
+		}
+	}
+}
+
+// codeLengthHeader writes the start of a final dynamic block with HLIT and
+// HDIST zero whose code length code has the given lengths, in the order of
+// codeLengthOrder, so that len(lengths) is HCLEN+4.
+func codeLengthHeader(lengths []uint32) []byte {
+	var b bytes.Buffer
+	bw := newBitWriter(&b)
+	bw.writeBits(1, 1)
+	bw.writeBits(2, 2)
+	bw.writeBits(0, 5)
+	bw.writeBits(0, 5)
+	bw.writeBits(uint32(len(lengths)-4), 4)
+	for _, l := range lengths {
+		bw.writeBits(l, 3)
+	}
+	bw.writeBits(0, 16)
+	bw.align()
+	bw.flush()
+	return b.Bytes()
+}
+
+func TestShortCodeLengthCode(t *testing.T) {
+	tests := []struct {
+		name    string
+		lengths []uint32
+	}{
+		// the codes for 16, 17, 18 and 0 leave a quarter of the code space
+		{"HCLEN 0, incomplete", []uint32{2, 2, 2, 0}},
+		{"HCLEN 0, one code", []uint32{0, 0, 0, 1}},
+		{"HCLEN 0, no codes", []uint32{0, 0, 0, 0}},
+		{"HCLEN 1, over-subscribed", []uint32{1, 1, 1, 0, 0}},
+	}
+	for _, tt := range tests {
+		if _, err := inflateAll(codeLengthHeader(tt.lengths)); !errors.Is(err, ErrBadHuffman) {
+			t.Errorf("%s: error %v, want ErrBadHuffman", tt.name, err)
+		}
+	}
+
+	// with a complete code the header is accepted and the all-zero code
+	// lengths that follow run out of input
+	if _, err := inflateAll(codeLengthHeader([]uint32{2, 2, 2, 2})); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("complete code: error %v, want io.ErrUnexpectedEOF", err)
+	}
+}
+
+func TestTrailer(t *testing.T) {
+	text := fixture(t, "rfc1952.txt")
+	data := gzipData(t, text, gzip.DefaultCompression)
+	wantCRC, wantSize := CRC32(text), uint32(len(text))
+
+	// a seekable source: the trailer is read from the end and the body is
+	// still there to decode afterwards
+	r := bytes.NewReader(data)
+	rb, err := NewReaderBuilder(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pos, _ := r.Seek(0, io.SeekCurrent)
+	read := rb.BytesRead()
+	crc, size, err := rb.Trailer()
+	if err != nil || crc != wantCRC || size != wantSize {
+		t.Fatalf("seekable: Trailer = %08x, %d, %v; want %08x, %d", crc, size, err, wantCRC, wantSize)
+	}
+	if now, _ := r.Seek(0, io.SeekCurrent); now != pos {
+		t.Errorf("seekable: source left at %d, want %d", now, pos)
+	}
+	if rb.BytesRead() != read {
+		t.Errorf("seekable: BytesRead went from %d to %d", read, rb.BytesRead())
+	}
+	zr, err := rb.Reader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ioutil.ReadAll(zr); err != nil || !bytes.Equal(got, text) {
+		t.Errorf("seekable: decoded %d bytes after Trailer, %v", len(got), err)
+	}
+
+	// the last member of a multistream file
+	two := append(gzipData(t, []byte("first"), gzip.DefaultCompression), data...)
+	rb, err = NewReaderBuilder(bytes.NewReader(two))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if crc, size, err := rb.Trailer(); err != nil || crc != wantCRC || size != wantSize {
+		t.Errorf("two members: Trailer = %08x, %d, %v", crc, size, err)
+	}
+
+	// a source that cannot seek is decoded to reach the trailer
+	rb, err = NewReaderBuilder(struct{ io.Reader }{bytes.NewReader(data)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if crc, size, err := rb.Trailer(); err != nil || crc != wantCRC || size != wantSize {
+		t.Errorf("not seekable: Trailer = %08x, %d, %v", crc, size, err)
+	}
+	if rb.BytesRead() != int64(len(data)) {
+		t.Errorf("not seekable: BytesRead = %d, want %d", rb.BytesRead(), len(data))
+	}
+	rb, err = NewReaderBuilder(struct{ io.Reader }{bytes.NewReader(tamper(data, -8, 0xff))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := rb.Trailer(); !errors.Is(err, ErrChecksum) {
+		t.Errorf("not seekable, bad CRC: error %v, want ErrChecksum", err)
+	}
+}
+
+func TestMixedBlocks(t *testing.T) {
+	lits := func(s string) []token {
+		var t []token
+		for i := 0; i < len(s); i++ {
+			t = append(t, literalToken(s[i]))
+		}
+		return t
+	}
+	stored := []byte("stored, then ")
+	// the fixed block copies "stored" and ", then" from the stored block,
+	// and the first match of the dynamic block spans both blocks before it
+	fixed := append(lits("fixed "), matchToken(6, 19), matchToken(6, 19))
+	dynamic := append(lits("dynamic: "), matchToken(18, 40), matchToken(3, 3))
+
+	var b bytes.Buffer
+	bw := newBitWriter(&b)
+	writeStoredBlock(bw, stored, false)
+	writeFixedBlock(bw, fixed, false)
+	h := lengthsHeader(literalLengths(), distanceLengths())
+	h.write(bw, true)
+	writeTokens(bw, dynamic, h.lit, h.dist)
+	bw.align()
+	bw.flush()
+
+	text := replay(t, replay(t, append([]byte(nil), stored...), fixed), dynamic)
+	if want := "stored, then fixed stored, thendynamic: stored, then fixedxed"; string(text) != want {
+		t.Fatalf("test tokens encode %q, want %q", text, want)
+	}
+	out, stats := decodeStats(t, gzipMember(b.Bytes(), text))
+	if !bytes.Equal(out, text) {
+		t.Errorf("decoded %q, want %q", out, text)
+	}
+	if len(stats) != 1 {
+		t.Fatalf("%d members", len(stats))
+	}
+	if s := stats[0]; s.StoredBlocks != 1 || s.FixedBlocks != 1 || s.DynamicBlocks != 1 || s.Matches != 4 {
+		t.Errorf("stats %+v, want one block of each type and 4 matches", s)
+	}
+}
+
+func TestTruncatedAfterBlock(t *testing.T) {
+	text := fixture(t, "rfc1952.txt")
+	var b bytes.Buffer
+	w := NewWriter(&b)
+	w.Write(text[:10000])
+	w.Flush()
+	// the flush ends with the byte-aligned empty stored block, so this is
+	// the boundary after a complete non-final block
+	cut := b.Len()
+	w.Write(text[10000:])
+	w.Close()
+	if got := gunzip(t, b.Bytes()); !bytes.Equal(got, text) {
+		t.Fatalf("whole stream decoded to %d bytes", len(got))
+	}
+
+	for _, n := range []int{cut, cut - 5} {
+		got, err := decodeAll(b.Bytes()[:n])
+		if !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("cut at %d: error %v, want io.ErrUnexpectedEOF", n, err)
+		}
+		if n == cut && !bytes.Equal(got, text[:10000]) {
+			t.Errorf("cut at %d: decoded %d bytes before the error, want 10000", n, len(got))
+		}
+	}
+}
+
+func TestHeaderBeforeBody(t *testing.T) {
+	text := fixture(t, "rfc1952.txt")
+	data := writeHeader(t, Header{Name: "rfc1952.txt", OS: 3}, text)
+	headerLen := int64(10 + len("rfc1952.txt") + 1)
+
+	r := bytes.NewReader(data)
+	rb, err := NewReaderBuilder(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rb.Name != "rfc1952.txt" || rb.OS != 3 {
+		t.Fatalf("header name %q, OS %d", rb.Name, rb.OS)
+	}
+	// only the header has been consumed, from the builder's view and from
+	// the source's
+	if n := rb.BytesRead(); n != headerLen {
+		t.Errorf("BytesRead = %d after the header, want %d", n, headerLen)
+	}
+	if pos, _ := r.Seek(0, io.SeekCurrent); pos != headerLen {
+		t.Errorf("source at %d after the header, want %d", pos, headerLen)
+	}
+
+	// a caller routing on the name only now decides to decode
+	if !strings.HasSuffix(rb.Name, ".txt") || rb.OSName() != "Unix" {
+		t.Fatalf("routing on %q, %q", rb.Name, rb.OSName())
+	}
+	zr, err := rb.Reader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(zr)
+	if err != nil || !bytes.Equal(got, text) {
+		t.Errorf("decoded %d bytes, %v; want %d", len(got), err, len(text))
+	}
+	if n := rb.BytesRead(); n != int64(len(data)) {
+		t.Errorf("BytesRead = %d after the body, want %d", n, len(data))
+	}
+}
@@ -0,0 +1,142 @@
+package hzip
+
+const (
+	minMatch = 3
+	maxMatch = 258
+
+	hashBits = 15
+	hashSize = 1 << hashBits
+
+	windowMask = windowSize - 1
+
+	defaultMaxChain = 128
+)
+
+// matcher is an LZ77 match finder. Positions of 3-byte sequences are kept in
+// hash chains: head holds the most recent position of each hash and prev
+// links every position to the previous one with the same hash. Positions are
+// absolute offsets into the uncompressed stream, stored plus one so that zero
+// means none.
+type matcher struct {
+	// maxChain bounds how many chain entries are tried for each position.
+	maxChain int
+	// lazy defers a match by one byte when the next position has a longer
+	// one.
+	lazy bool
+
+	// hist holds up to windowSize bytes of already tokenized data followed
+	// by the block being tokenized; base is the absolute offset of hist[0].
+	hist []byte
+	base int
+
+	head [hashSize]int
+	prev [windowSize]int
+}
+
+func newMatcher(maxChain int) *matcher {
+	return &matcher{maxChain: maxChain}
+}
+
+func hash3(b []byte) int {
+	return int((uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16) * 0x1e35a7bd >> (32 - hashBits))
+}
+
+// insert adds the sequence starting at hist[i] to the hash chains.
+func (m *matcher) insert(i int) {
+	h := hash3(m.hist[i:])
+	p := m.base + i
+	m.prev[p&windowMask] = m.head[h]
+	m.head[h] = p + 1
+}
+
+// findMatch returns the length and distance of the longest match for the
+// data at hist[i:end] within the window, or a length of 0.
+func (m *matcher) findMatch(i, end int) (int, int) {
+	limit := end - i
+	if limit > maxMatch {
+		limit = maxMatch
+	}
+	p := m.base + i
+	bestLen, bestDist := 0, 0
+	cand := m.head[hash3(m.hist[i:])]
+	for chain := m.maxChain; cand > 0 && chain > 0; chain-- {
+		c := cand - 1
+		if p-c > windowSize {
+			break
+		}
+		// a match may overlap the data it copies, so c+n can run past i
+		j := c - m.base
+		n := 0
+		for n < limit && m.hist[j+n] == m.hist[i+n] {
+			n++
+		}
+		if n > bestLen {
+			bestLen, bestDist = n, p-c
+			if n == limit {
+				break
+			}
+		}
+		cand = m.prev[c&windowMask]
+	}
+	if bestLen < minMatch {
+		return 0, 0
+	}
+	return bestLen, bestDist
+}
+
+// reset forgets the window, so that no later match refers to data before
+// this point. Clearing head is enough, as every chain starts there.
+func (m *matcher) reset() {
+	m.base += len(m.hist)
+	m.hist = m.hist[:0]
+	m.head = [hashSize]int{}
+}
+
+// tokenize appends the tokens of block to tokens. Matches may refer to data
+// of earlier blocks, up to windowSize bytes back.
+func (m *matcher) tokenize(block []byte, tokens []token) []token {
+	start := len(m.hist)
+	m.hist = append(m.hist, block...)
+	end := len(m.hist)
+
+	for i := start; i < end; {
+		if end-i < minMatch {
+			tokens = append(tokens, literalToken(m.hist[i]))
+			i++
+			continue
+		}
+		length, dist := m.findMatch(i, end)
+		if m.lazy && length > 0 && length < maxMatch && end-i > minMatch {
+			m.insert(i)
+			if next, _ := m.findMatch(i+1, end); next > length {
+				tokens = append(tokens, literalToken(m.hist[i]))
+				i++
+				continue
+			}
+			tokens = append(tokens, matchToken(length, dist))
+			for k := i + 1; k < i+length && end-k >= minMatch; k++ {
+				m.insert(k)
+			}
+			i += length
+			continue
+		}
+		if length == 0 {
+			m.insert(i)
+			tokens = append(tokens, literalToken(m.hist[i]))
+			i++
+			continue
+		}
+		tokens = append(tokens, matchToken(length, dist))
+		for k := i; k < i+length && end-k >= minMatch; k++ {
+			m.insert(k)
+		}
+		i += length
+	}
+
+	if n := len(m.hist) - windowSize; n > 0 {
+		copy(m.hist, m.hist[n:])
+		m.hist = m.hist[:windowSize]
+		m.base += n
+	}
+	return tokens
+}
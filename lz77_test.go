@@ -0,0 +1,90 @@
+package hzip
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+// replay appends the data that tokens encode to out, which holds the data of
+// earlier blocks, checking that every match is within the limits of DEFLATE.
+func replay(t *testing.T, out []byte, tokens []token) []byte {
+	t.Helper()
+	for _, tok := range tokens {
+		if !tok.isMatch() {
+			out = append(out, tok.literal())
+			continue
+		}
+		n, d := tok.length(), tok.dist()
+		if n < minMatch || n > maxMatch || d < 1 || d > windowSize || d > len(out) {
+			t.Fatalf("match of length %d at distance %d after %d bytes", n, d, len(out))
+		}
+		for i := 0; i < n; i++ {
+			out = append(out, out[len(out)-d])
+		}
+	}
+	return out
+}
+
+func TestTokenizeRepetitive(t *testing.T) {
+	data := bytes.Repeat([]byte("a"), 100000)
+	tokens := newMatcher(defaultMaxChain).tokenize(data, nil)
+	if got := replay(t, nil, tokens); !bytes.Equal(got, data) {
+		t.Fatal("tokens do not reproduce the input")
+	}
+	// one literal, then overlapping matches of the longest length
+	if n := len(tokens); n > 2+len(data)/maxMatch {
+		t.Errorf("%d tokens for %d bytes of one value", n, len(data))
+	}
+	if tok := tokens[1]; !tok.isMatch() || tok.length() != maxMatch || tok.dist() != 1 {
+		t.Errorf("second token is not a %d-byte match at distance 1", maxMatch)
+	}
+}
+
+func TestTokenizeBlocks(t *testing.T) {
+	rnd := rand.New(rand.NewSource(25))
+	head := make([]byte, 64)
+	rnd.Read(head)
+	filler := func(n int) []byte {
+		b := make([]byte, n)
+		rnd.Read(b)
+		return b
+	}
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"text", bytes.Repeat(fixture(t, "rfc1952.txt"), 3)},
+		// head repeats exactly windowSize bytes back, and once just beyond
+		{"window edge", append(append(append([]byte(nil), head...), filler(windowSize-len(head))...), head...)},
+		{"past the window", append(append(append([]byte(nil), head...), filler(windowSize+1-len(head))...), head...)},
+	}
+	for _, tt := range tests {
+		for _, lazy := range []bool{false, true} {
+			m := newMatcher(defaultMaxChain)
+			m.lazy = lazy
+			var out []byte
+			var matched int
+			for data := tt.data; len(data) > 0; {
+				n := 10000
+				if n > len(data) {
+					n = len(data)
+				}
+				tokens := m.tokenize(data[:n], nil)
+				for _, tok := range tokens {
+					if tok.isMatch() {
+						matched += tok.length()
+					}
+				}
+				out = replay(t, out, tokens)
+				data = data[n:]
+			}
+			if !bytes.Equal(out, tt.data) {
+				t.Errorf("%s, lazy %t: tokens do not reproduce the input", tt.name, lazy)
+			}
+			if tt.name == "window edge" && matched < len(head) {
+				t.Errorf("%s, lazy %t: the repeat %d bytes back was not matched", tt.name, lazy, windowSize)
+			}
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package hzip
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"runtime"
+)
+
+// WithConcurrency bounds the number of members DecompressParallel decodes at
+// once. It defaults to GOMAXPROCS.
+func WithConcurrency(n int) Option {
+	return func(rb *ReaderBuilder) {
+		rb.concurrency = n
+	}
+}
+
+// memberResult is the decoded data of one member and its trailer CRC-32.
+type memberResult struct {
+	data []byte
+	crc  uint32
+	err  error
+}
+
+// DecompressParallel decodes the size bytes of the multistream gzip file r to
+// w, decoding members concurrently and writing them in order. It returns the
+// number of bytes written and the CRC-32 of all of them, combined from the
+// checked CRC-32 of each member.
+//
+// Members are only independent once their boundaries are known. Those of a
+// BGZF file are read from the BC extra subfield of each header; any other
+// member has to be decoded to find where it ends, so it is decoded as it is
+// scanned, and a file without BGZF headers decodes sequentially.
+func DecompressParallel(w io.Writer, r io.ReaderAt, size int64, opts ...Option) (int64, uint32, error) {
+	workers := applyOptions(opts).concurrency
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	opts = append(opts[:len(opts):len(opts)], WithMultistream(false))
+
+	// results holds one channel per member, in file order; its capacity and
+	// sem bound the members decoded or waiting to be written
+	results := make(chan chan memberResult, workers)
+	sem := make(chan struct{}, workers)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		defer close(results)
+		for off := int64(0); off < size; {
+			ch := make(chan memberResult, 1)
+			select {
+			case results <- ch:
+			case <-done:
+				return
+			}
+			rb, err := NewReaderBuilder(io.NewSectionReader(r, off, size-off), opts...)
+			if err != nil {
+				ch <- memberResult{err: err}
+				return
+			}
+			if n, ok := rb.BGZFBlockSize(); ok {
+				select {
+				case sem <- struct{}{}:
+				case <-done:
+					return
+				}
+				go func(off, n int64) {
+					ch <- decodeMember(io.NewSectionReader(r, off, n), n, opts)
+					<-sem
+				}(off, int64(n))
+				off += int64(n)
+				continue
+			}
+			res := readMember(rb)
+			ch <- res
+			if res.err != nil {
+				return
+			}
+			off += rb.BytesRead()
+		}
+	}()
+
+	var total int64
+	var crc uint32
+	for ch := range results {
+		res := <-ch
+		if res.err != nil {
+			return total, crc, res.err
+		}
+		n, err := w.Write(res.data)
+		total += int64(n)
+		if err != nil {
+			return total, crc, err
+		}
+		crc = crc32Combine(crc, res.crc, int64(len(res.data)))
+	}
+	return total, crc, nil
+}
+
+// decodeMember decodes the member of n bytes, as recorded by BGZF, read from
+// r.
+func decodeMember(r io.Reader, n int64, opts []Option) memberResult {
+	rb, err := NewReaderBuilder(r, opts...)
+	if err != nil {
+		return memberResult{err: err}
+	}
+	res := readMember(rb)
+	if res.err == nil && rb.BytesRead() != n {
+		res.err = fmt.Errorf("%w: BGZF block size %d does not match the member", ErrBadExtra, n)
+	}
+	return res
+}
+
+// readMember decodes the single member of rb.
+func readMember(rb *ReaderBuilder) memberResult {
+	zr, err := rb.Reader()
+	if err != nil {
+		return memberResult{err: err}
+	}
+	data, err := ioutil.ReadAll(zr)
+	if err != nil {
+		return memberResult{err: err}
+	}
+	return memberResult{data: data, crc: rb.d.trailerCRC}
+}
@@ -0,0 +1,74 @@
+package hzip
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"testing"
+)
+
+// multiMember splits data into members of n bytes each, written by member.
+func multiMember(data []byte, n int, member func([]byte) []byte) []byte {
+	var b bytes.Buffer
+	for off := 0; off < len(data); off += n {
+		end := off + n
+		if end > len(data) {
+			end = len(data)
+		}
+		b.Write(member(data[off:end]))
+	}
+	return b.Bytes()
+}
+
+func TestDecompressParallel(t *testing.T) {
+	text := fixture(t, "rfc1952.txt")
+	files := map[string][]byte{
+		"bgzf":  multiMember(text, 1000, func(p []byte) []byte { return bgzfMember(t, p) }),
+		"plain": multiMember(text, 1000, func(p []byte) []byte { return gzipData(t, p, gzip.DefaultCompression) }),
+		"one":   gzipData(t, text, gzip.DefaultCompression),
+	}
+	for name, file := range files {
+		want, err := decodeAll(file)
+		if err != nil || !bytes.Equal(want, text) {
+			t.Fatalf("%s: sequential decode: %d bytes, %v", name, len(want), err)
+		}
+		for _, workers := range []int{0, 1, 4, 64} {
+			var got bytes.Buffer
+			n, crc, err := DecompressParallel(&got, bytes.NewReader(file), int64(len(file)), WithConcurrency(workers))
+			if err != nil {
+				t.Errorf("%s, %d workers: %v", name, workers, err)
+				continue
+			}
+			if n != int64(len(want)) || !bytes.Equal(got.Bytes(), want) {
+				t.Errorf("%s, %d workers: wrote %d bytes, want %d", name, workers, n, len(want))
+			}
+			if crc != CRC32(want) {
+				t.Errorf("%s, %d workers: CRC-32 %08x, want %08x", name, workers, crc, CRC32(want))
+			}
+		}
+	}
+}
+
+func TestDecompressParallelErrors(t *testing.T) {
+	text := fixture(t, "rfc1952.txt")
+	file := multiMember(text, 1000, func(p []byte) []byte { return bgzfMember(t, p) })
+
+	// a bad CRC-32 in the trailer of the first member
+	bad := tamper(file, len(bgzfMember(t, text[:1000]))-8, 0xff)
+	var got bytes.Buffer
+	n, _, err := DecompressParallel(&got, bytes.NewReader(bad), int64(len(bad)), WithConcurrency(4))
+	if !errors.Is(err, ErrChecksum) {
+		t.Errorf("bad checksum: error %v, want ErrChecksum", err)
+	}
+	if n != 0 || got.Len() != 0 {
+		t.Errorf("bad checksum: wrote %d bytes before the failing member", n)
+	}
+
+	// a BC subfield that disagrees with where the member ends
+	first := bgzfMember(t, text[:1000])
+	le.PutUint16(first[16:18], uint16(len(first)))
+	short := append(first, file[len(first):]...)
+	if _, _, err := DecompressParallel(&got, bytes.NewReader(short), int64(len(short))); !errors.Is(err, ErrBadExtra) {
+		t.Errorf("wrong block size: error %v, want ErrBadExtra", err)
+	}
+}
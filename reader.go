@@ -0,0 +1,411 @@
+package hzip
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"sync"
+)
+
+var ErrReaderClosed = errors.New("hunzip: read from closed reader")
+
+// windowSize is the maximum distance of a DEFLATE back-reference.
+const windowSize = 32 << 10
+
+// window is the backing array of a decompressor's hist: the retained window,
+// a refill of up to windowSize bytes, and the overshoot of a final match.
+type window [2*windowSize + maxMatch]byte
+
+// windowPool holds windows for reuse by later readers. Windows are cleared
+// before they are put back, so no decoded data outlives its reader.
+var windowPool = sync.Pool{
+	New: func() interface{} { return new(window) },
+}
+
+// Kinds of block being decoded.
+const (
+	blockNone = iota
+	blockStored
+	blockHuffman
+)
+
+// decompressor is a streaming reader over the gzip members of a
+// ReaderBuilder, over a zlib stream when adler is set, or over a raw DEFLATE
+// stream otherwise. Each refill decodes up to windowSize bytes and appends
+// them to hist, which also retains the last windowSize bytes that were
+// already returned so that back-references can reach into earlier blocks.
+// Decoding stops in the middle of a block when needed, so memory stays
+// bounded and input is only consumed as output is read.
+type decompressor struct {
+	rb  *ReaderBuilder
+	r   io.ByteReader
+	br  *bitReader
+	ctx context.Context
+
+	// max limits the total output when positive; total counts it.
+	max   int64
+	total int64
+
+	win  *window
+	hist []byte
+	rpos int
+	dict []byte
+
+	// state of the block being decoded
+	block    int
+	stored   int
+	literal  *huffmanDecoder
+	distance *huffmanDecoder
+
+	// nodes of the code length tree and the decoders of dynamic blocks,
+	// rebuilt in place by every dynamic block
+	clTree      []HuffmanTree
+	dynLiteral  huffmanDecoder
+	dynDistance huffmanDecoder
+
+	final bool
+	crc   uint32
+	adler hash.Hash32
+	size  uint32
+	err   error
+
+	// statistics per member, and those of the current member when collected
+	stats []Stats
+	st    *Stats
+
+	// trailer of the last member finished
+	trailerCRC  uint32
+	trailerSize uint32
+}
+
+// NewDeflateReader returns a reader that decodes a raw DEFLATE stream, as
+// defined by RFC 1951, without any gzip header or trailer. A stream written
+// with a preset dictionary needs the same dictionary, given with
+// WithDictionary. Input that ends before a block marked final is reported as
+// io.ErrUnexpectedEOF.
+func NewDeflateReader(r io.Reader, opts ...Option) (io.Reader, error) {
+	cfg := applyOptions(opts)
+	return &decompressor{r: &countingReader{r: cfg.newBuffer(r)}, max: cfg.MaxOutputSize, dict: cfg.dict}, nil
+}
+
+// NewFlateReader is NewDeflateReader with the signature of
+// compress/flate.NewReader, so that it can be used in its place. Close
+// releases the decoder, returning any error that stopped decoding.
+//
+// The rest of compress/flate maps onto this package as follows:
+// flate.NewReaderDict is NewDeflateReader with WithDictionary, a
+// flate.CorruptInputError, which holds an input offset, is one of ErrBadCode,
+// whose message gives the offset, ErrBadHuffman, ErrBadDistance or
+// ErrBadStoredLength, and truncated input, which compress/flate reports as
+// io.ErrUnexpectedEOF, is an error matching io.ErrUnexpectedEOF.
+// There is no flate.Resetter; create a new reader for each stream.
+func NewFlateReader(r io.Reader) io.ReadCloser {
+	return &decompressor{r: &countingReader{r: applyOptions(nil).newBuffer(r)}}
+}
+
+func (d *decompressor) logf(format string, v ...interface{}) {
+	if d.rb != nil {
+		d.rb.logf(format, v...)
+	}
+}
+
+func (d *decompressor) Read(p []byte) (int, error) {
+	for d.rpos == len(d.hist) {
+		if d.err != nil {
+			d.release()
+			return 0, d.err
+		}
+		d.err = d.step()
+	}
+	n := copy(p, d.hist[d.rpos:])
+	d.rpos += n
+	return n, nil
+}
+
+// Close releases the decoding window. It returns the error that stopped
+// decoding, if any, other than io.EOF. Reads after Close fail with that error,
+// or with ErrReaderClosed.
+func (d *decompressor) Close() error {
+	err := d.err
+	switch err {
+	case ErrReaderClosed, io.EOF:
+		err = nil
+	}
+	if err == nil {
+		d.err = ErrReaderClosed
+	}
+	d.release()
+	d.literal, d.distance = nil, nil
+	return err
+}
+
+// release returns the window to windowPool once decoding has stopped and all
+// of hist has been read.
+func (d *decompressor) release() {
+	if d.win == nil {
+		return
+	}
+	*d.win = window{}
+	windowPool.Put(d.win)
+	d.win, d.hist, d.rpos = nil, nil, 0
+}
+
+// WriteTo writes the remaining decoded data to w, starting with anything
+// decoded but not yet returned by Read.
+func (d *decompressor) WriteTo(w io.Writer) (int64, error) {
+	var total int64
+	for {
+		if d.rpos < len(d.hist) {
+			n, err := w.Write(d.hist[d.rpos:])
+			d.rpos += n
+			total += int64(n)
+			if err != nil {
+				return total, err
+			}
+		}
+		if d.err != nil {
+			d.release()
+			if d.err == io.EOF {
+				return total, nil
+			}
+			return total, d.err
+		}
+		d.err = d.step()
+	}
+}
+
+// step decodes more of the current block, starting the next block or
+// finishing the current member when needed. It is only called when all of
+// hist has been read. Only a block marked final leads to finishMember, so
+// input that ends after a non-final block fails in readBlockHeader with
+// io.ErrUnexpectedEOF.
+func (d *decompressor) step() error {
+	if d.ctx != nil {
+		if err := d.ctx.Err(); err != nil {
+			return err
+		}
+	}
+	if d.br == nil {
+		r, err := newBitReader(d.r)
+		if err != nil {
+			return err
+		}
+		d.br = r
+	}
+	if d.block == blockNone {
+		if d.final {
+			return d.finishMember()
+		}
+		if err := d.readBlockHeader(); err != nil {
+			return d.codeError(err)
+		}
+	}
+
+	// With a limit, decode at most one byte past it, so that a stream ending
+	// exactly at MaxOutputSize is not reported as too large.
+	want, over := int64(windowSize), false
+	if d.max > 0 {
+		if rem := d.max - d.total; rem < want {
+			want = rem + 1
+		}
+	}
+
+	if d.win == nil {
+		d.win = windowPool.Get().(*window)
+		d.hist = d.win[:0]
+		d.preload()
+	}
+	d.slide()
+	hist, n := d.hist, len(d.hist)
+	var err error
+	switch d.block {
+	case blockStored:
+		hist, err = d.unzipStored(d.br, hist, n+int(want))
+	case blockHuffman:
+		hist, err = d.inflate(d.br, d.literal, d.distance, hist, n+int(want))
+	}
+	if err != nil {
+		if d.block == blockHuffman && errors.Is(err, io.ErrUnexpectedEOF) {
+			err = &eobError{err}
+		}
+		return d.codeError(err)
+	}
+	if d.max > 0 && d.total+int64(len(hist)-n) > d.max {
+		hist = hist[:n+int(d.max-d.total)]
+		over = true
+	}
+
+	d.hist = hist
+	switch {
+	case d.adler != nil:
+		d.adler.Write(hist[n:])
+	case d.rb != nil:
+		d.crc = UpdateCRC32(d.crc, hist[n:])
+	}
+	d.size += uint32(len(hist) - n)
+	d.total += int64(len(hist) - n)
+	if over {
+		return ErrOutputLimit
+	}
+	return nil
+}
+
+// readBlockHeader starts the next block. Stored, fixed and dynamic blocks may
+// follow each other in any order, and all of them decode into the same hist.
+func (d *decompressor) readBlockHeader() error {
+	bFinal, err := d.br.readBit()
+	if err != nil {
+		return err
+	}
+	d.final = bFinal > 0
+	bType, err := d.br.readBits(2)
+	if err != nil {
+		return err
+	}
+	d.logf("block: type=%d final=%t", bType, d.final)
+	if d.st != nil {
+		switch bType {
+		case 0:
+			d.st.StoredBlocks++
+		case 1:
+			d.st.FixedBlocks++
+		case 2:
+			d.st.DynamicBlocks++
+		}
+	}
+	switch bType {
+	case 0:
+		err = d.readStoredHeader(d.br)
+		d.block = blockStored
+	case 1:
+		d.literal, d.distance = fixedHuffmanDecoders()
+		d.block = blockHuffman
+	case 2:
+		d.literal, d.distance, err = d.readDynamicHuffman(d.br)
+		d.block = blockHuffman
+	case 3:
+		err = fmt.Errorf("hunzip: invalid block type %d", bType)
+	}
+	return err
+}
+
+// eobError reports input that ends inside a compressed block, before its
+// end-of-block code. It matches both ErrBadCode and io.ErrUnexpectedEOF.
+type eobError struct {
+	err error
+}
+
+func (e *eobError) Error() string {
+	return "hunzip: invalid Huffman code: input ended before the end-of-block code"
+}
+
+func (e *eobError) Is(target error) bool {
+	return target == ErrBadCode
+}
+
+func (e *eobError) Unwrap() error {
+	return e.err
+}
+
+// codeError adds the input offset at which it was detected to an ErrBadCode
+// error.
+func (d *decompressor) codeError(err error) error {
+	if errors.Is(err, ErrBadCode) {
+		return fmt.Errorf("%w at input offset %d", err, d.offset())
+	}
+	return err
+}
+
+// offset returns the number of input bytes consumed by the decoder, not
+// counting whole bytes it holds in its bit buffer.
+func (d *decompressor) offset() int64 {
+	cr, ok := d.r.(*countingReader)
+	if !ok {
+		return 0
+	}
+	n := cr.n
+	if d.br != nil {
+		n -= int64(d.br.nbits / 8)
+	}
+	return n
+}
+
+// preload fills the empty window with the end of the preset dictionary, if
+// any, so that back-references can reach it. It is never returned by Read.
+func (d *decompressor) preload() {
+	dict := d.dict
+	if len(dict) > windowSize {
+		dict = dict[len(dict)-windowSize:]
+	}
+	d.hist = append(d.hist, dict...)
+	d.rpos = len(d.hist)
+}
+
+// slide drops history older than the window. All of hist must have been read.
+func (d *decompressor) slide() {
+	if n := len(d.hist) - windowSize; n > 0 {
+		copy(d.hist, d.hist[n:])
+		d.hist = d.hist[:windowSize]
+		d.rpos = windowSize
+	}
+}
+
+// finishMember verifies the trailer of the current member and, in multistream
+// mode, reads the header of the next one. It returns io.EOF at the end of the
+// stream. A raw DEFLATE stream ends with its final block.
+func (d *decompressor) finishMember() error {
+	if d.adler != nil {
+		return d.finishZlib()
+	}
+	if d.rb == nil {
+		return io.EOF
+	}
+	d.br.align()
+	crc, err := d.br.readUint32()
+	if err != nil {
+		return err
+	}
+	if crc != d.crc {
+		return &ChecksumError{Expected: crc, Computed: d.crc}
+	}
+	// ISIZE and size both hold the length modulo 2^32, so members of 4GB
+	// and more compare correctly, though the length itself is then only
+	// checked modulo 2^32 and the CRC is the real integrity check.
+	isize, err := d.br.readUint32()
+	if err != nil {
+		return err
+	}
+	if isize != d.size {
+		return ErrSize
+	}
+	d.trailerCRC, d.trailerSize = crc, isize
+
+	if !d.rb.multistream {
+		return io.EOF
+	}
+	// trailing data that cannot start a member ends the stream
+	if c, err := d.rb.src.ReadByte(); err == io.EOF {
+		return io.EOF
+	} else if err == nil {
+		if c != 0x1f {
+			d.logf("ignoring trailing data after member")
+			return io.EOF
+		}
+		d.rb.src.UnreadByte()
+	}
+	if err := d.rb.readHeaders(); err != nil {
+		return err
+	}
+	if err := d.br.reset(d.r); err != nil {
+		return err
+	}
+	d.hist = d.hist[:0]
+	d.rpos = 0
+	d.final = false
+	d.crc = 0
+	d.size = 0
+	d.startStats()
+	return nil
+}
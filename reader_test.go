@@ -0,0 +1,340 @@
+package hzip
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"io/ioutil"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// deflateData compresses data into a raw DEFLATE stream with compress/flate.
+func deflateData(tb testing.TB, data []byte, level int) []byte {
+	tb.Helper()
+	var b bytes.Buffer
+	w, err := flate.NewWriter(&b, level)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		tb.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		tb.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+// inflateAll decodes a whole raw DEFLATE stream through NewDeflateReader.
+func inflateAll(data []byte, opts ...Option) ([]byte, error) {
+	r, err := NewDeflateReader(bytes.NewReader(data), opts...)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+func TestBadCodeOffset(t *testing.T) {
+	// a final fixed block holding only the literal/length code 287
+	_, err := inflateAll([]byte{0x1b, 0x07})
+	if !errors.Is(err, ErrBadCode) {
+		t.Fatalf("error %v, want ErrBadCode", err)
+	}
+	if !strings.Contains(err.Error(), "symbol 287 at input offset 2") {
+		t.Errorf("error %q does not give the symbol and offset", err)
+	}
+}
+
+func TestMissingEndOfBlock(t *testing.T) {
+	data := deflateData(t, fixture(t, "rfc1952.txt"), 6)
+	_, err := inflateAll(data[:len(data)/2])
+	if !errors.Is(err, ErrBadCode) || !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("error %v, want both ErrBadCode and io.ErrUnexpectedEOF", err)
+	}
+	if !strings.Contains(err.Error(), "input offset") {
+		t.Errorf("error %q does not give the offset", err)
+	}
+
+	// a stream cut between blocks has no block to end
+	_, err = inflateAll(nil)
+	if !errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, ErrBadCode) {
+		t.Errorf("empty input: error %v, want io.ErrUnexpectedEOF only", err)
+	}
+}
+
+func TestReleaseClearsWindow(t *testing.T) {
+	r, err := NewReader(bytes.NewReader(gzipData(t, []byte("secret payload"), 6)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := r.(*decompressor)
+	// stop partway, so that the window still holds data when it is released
+	if _, err := r.Read(make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+	win := d.win
+	if win == nil {
+		t.Fatal("no window after the first read")
+	}
+	r.Close()
+	if d.win != nil {
+		t.Fatal("Close kept the window")
+	}
+	if *win != (window{}) {
+		t.Error("released window still holds decoded data")
+	}
+}
+
+func TestDeflateReader(t *testing.T) {
+	text := fixture(t, "rfc1952.txt")
+	for _, level := range []int{flate.HuffmanOnly, flate.NoCompression, flate.BestSpeed, flate.DefaultCompression, flate.BestCompression} {
+		raw := deflateData(t, text, level)
+		got, err := inflateAll(raw)
+		if err != nil || !bytes.Equal(got, text) {
+			t.Errorf("level %d: decoded %d bytes, %v; want %d", level, len(got), err, len(text))
+		}
+		// there is no trailer, so whatever follows the final block is not read
+		got, err = inflateAll(append(raw, "not deflate"...))
+		if err != nil || !bytes.Equal(got, text) {
+			t.Errorf("level %d with trailing data: decoded %d bytes, %v", level, len(got), err)
+		}
+	}
+	if got, err := inflateAll(deflateData(t, nil, flate.DefaultCompression)); err != nil || len(got) != 0 {
+		t.Errorf("empty stream: decoded %q, %v", got, err)
+	}
+}
+
+func TestPipeStreaming(t *testing.T) {
+	text := fixture(t, "rfc1952.txt")
+	half := len(text) / 2
+	var b bytes.Buffer
+	w := NewWriter(&b)
+	w.Write(text[:half])
+	w.Flush()
+	flushed := b.Len()
+	w.Write(text[half:])
+	w.Close()
+	data := b.Bytes()
+
+	pr, pw := io.Pipe()
+	// a decoder that waited for more input than it needs would block forever
+	timer := time.AfterFunc(10*time.Second, func() {
+		pw.CloseWithError(errors.New("timed out waiting for output"))
+	})
+	defer timer.Stop()
+	firstRead := make(chan struct{})
+	go func() {
+		for i := 0; i < flushed; i += 100 {
+			end := i + 100
+			if end > flushed {
+				end = flushed
+			}
+			pw.Write(data[i:end])
+		}
+		<-firstRead
+		pw.Write(data[flushed:])
+		pw.Close()
+	}()
+
+	r, err := NewReader(pr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, half)
+	if _, err := io.ReadFull(r, got); err != nil {
+		t.Fatalf("first half, before the rest was written: %v", err)
+	}
+	close(firstRead)
+	rest, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got = append(got, rest...); !bytes.Equal(got, text) {
+		t.Errorf("decoded %d bytes, want %d", len(got), len(text))
+	}
+}
+
+func TestWriteTo(t *testing.T) {
+	data := fixture(t, "rfc1952.txt.gz")
+	want := fixture(t, "rfc1952.txt")
+	for _, first := range []int{0, 1, 1000, len(want)} {
+		r, err := NewReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		head := make([]byte, first)
+		if _, err := io.ReadFull(r, head); err != nil {
+			t.Fatal(err)
+		}
+		var b bytes.Buffer
+		n, err := r.(io.WriterTo).WriteTo(&b)
+		if err != nil || n != int64(len(want)-first) {
+			t.Errorf("after %d bytes read: WriteTo = %d, %v; want %d", first, n, err, len(want)-first)
+		}
+		if got := append(head, b.Bytes()...); !bytes.Equal(got, want) {
+			t.Errorf("after %d bytes read: output differs from a full decode", first)
+		}
+	}
+}
+
+func TestClose(t *testing.T) {
+	data := fixture(t, "rfc1952.txt.gz")
+	open := func(data []byte) io.ReadCloser {
+		r, err := NewReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+
+	r := open(data)
+	if _, err := io.Copy(ioutil.Discard, r); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Close(); err != nil {
+		t.Errorf("Close after the whole stream: %v", err)
+	}
+	if _, err := r.Read(make([]byte, 1)); err != ErrReaderClosed {
+		t.Errorf("Read after Close: error %v, want ErrReaderClosed", err)
+	}
+	if err := r.Close(); err != nil {
+		t.Errorf("second Close: %v", err)
+	}
+
+	r = open(data)
+	r.Read(make([]byte, 10))
+	if err := r.Close(); err != nil {
+		t.Errorf("Close partway: %v", err)
+	}
+
+	r = open(tamper(data, -8, 0x01))
+	io.Copy(ioutil.Discard, r)
+	if err := r.Close(); !errors.Is(err, ErrChecksum) {
+		t.Errorf("Close after a bad trailer: error %v, want ErrChecksum", err)
+	}
+	if _, err := r.Read(make([]byte, 1)); !errors.Is(err, ErrChecksum) {
+		t.Errorf("Read after Close: error %v, want ErrChecksum", err)
+	}
+}
+
+func TestDeflateDictionary(t *testing.T) {
+	text := bytes.Repeat(fixture(t, "rfc1952.txt"), 2)
+	dict, body := text[:windowSize], text[windowSize-5000:windowSize+3000]
+	var b bytes.Buffer
+	w, err := flate.NewWriterDict(&b, flate.BestCompression, dict)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(body)
+	w.Close()
+	raw := b.Bytes()
+
+	got, err := inflateAll(raw, WithDictionary(dict))
+	if err != nil || !bytes.Equal(got, body) {
+		t.Errorf("with the dictionary: decoded %d bytes, %v; want %d", len(got), err, len(body))
+	}
+	if want, err := ioutil.ReadAll(flate.NewReaderDict(bytes.NewReader(raw), dict)); err != nil || !bytes.Equal(got, want) {
+		t.Errorf("output differs from compress/flate: %v", err)
+	}
+	if _, err := inflateAll(raw); err != ErrBadDistance {
+		t.Errorf("without the dictionary: error %v, want ErrBadDistance", err)
+	}
+
+	// only the last windowSize bytes of a longer dictionary are used
+	long := append(bytes.Repeat([]byte("x"), 1000), dict...)
+	if got, err := inflateAll(raw, WithDictionary(long)); err != nil || !bytes.Equal(got, body) {
+		t.Errorf("long dictionary: decoded %d bytes, %v", len(got), err)
+	}
+}
+
+func TestSizeWraparound(t *testing.T) {
+	text := fixture(t, "rfc1952.txt")
+	data := gzipData(t, text, 6)
+	// as if 2^32-256 bytes had already been decoded, so that the ISIZE of
+	// the whole member wraps around to len(text)-256
+	const before uint32 = 1<<32 - 256
+	wrapped := before + uint32(len(text))
+	for _, isize := range []uint32{wrapped, uint32(len(text))} {
+		le.PutUint32(data[len(data)-4:], isize)
+		r, err := NewReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.(*decompressor).size = before
+		_, err = ioutil.ReadAll(r)
+		if isize == wrapped && err != nil {
+			t.Errorf("wrapped ISIZE %d: %v", isize, err)
+		} else if isize != wrapped && err != ErrSize {
+			t.Errorf("unwrapped ISIZE %d: error %v, want ErrSize", isize, err)
+		}
+	}
+}
+
+func TestStreamingChecksum(t *testing.T) {
+	text := bytes.Repeat(fixture(t, "rfc1952.txt"), 600)
+	data := tamper(gzipData(t, text, 6), -8, 0x01)
+
+	r, err := NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	buf := make([]byte, 4096)
+	var n int
+	for err == nil {
+		var m int
+		m, err = r.Read(buf)
+		if !bytes.Equal(buf[:m], text[n:n+m]) {
+			t.Fatalf("bytes %d to %d differ", n, n+m)
+		}
+		n += m
+	}
+	runtime.ReadMemStats(&after)
+
+	if !errors.Is(err, ErrChecksum) || n != len(text) {
+		t.Errorf("read %d of %d bytes, then error %v; want ErrChecksum at the end", n, len(text), err)
+	}
+	if alloc := after.TotalAlloc - before.TotalAlloc; alloc > uint64(len(text)/10) {
+		t.Errorf("allocated %d bytes to stream %d", alloc, len(text))
+	}
+}
+
+func TestFlateReader(t *testing.T) {
+	text := fixture(t, "rfc1952.txt")
+	for _, level := range []int{flate.NoCompression, flate.BestSpeed, flate.DefaultCompression, flate.BestCompression, flate.HuffmanOnly} {
+		data := deflateData(t, text, level)
+		r := NewFlateReader(bytes.NewReader(data))
+		got, err := ioutil.ReadAll(r)
+		if err != nil || !bytes.Equal(got, text) {
+			t.Errorf("level %d: decoded %d bytes, %v", level, len(got), err)
+		}
+		if err := r.Close(); err != nil {
+			t.Errorf("level %d: Close = %v", level, err)
+		}
+
+		// and it stands in for compress/flate.NewReader
+		var newReader func(io.Reader) io.ReadCloser = NewFlateReader
+		want, err := ioutil.ReadAll(flate.NewReader(bytes.NewReader(data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := ioutil.ReadAll(newReader(bytes.NewReader(data))); !bytes.Equal(got, want) {
+			t.Errorf("level %d: output differs from compress/flate", level)
+		}
+	}
+
+	// truncated input is io.ErrUnexpectedEOF, as in compress/flate
+	data := deflateData(t, text, flate.DefaultCompression)
+	r := NewFlateReader(bytes.NewReader(data[:len(data)/2]))
+	if _, err := ioutil.ReadAll(r); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("truncated: error %v, want io.ErrUnexpectedEOF", err)
+	}
+	if err := r.Close(); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("truncated: Close = %v, want io.ErrUnexpectedEOF", err)
+	}
+}
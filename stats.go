@@ -0,0 +1,46 @@
+package hzip
+
+// Stats counts what was decoded from one gzip member.
+type Stats struct {
+	StoredBlocks  int
+	FixedBlocks   int
+	DynamicBlocks int
+	Literals      int64
+	Matches       int64
+	MatchBytes    int64 // total length of all matches
+}
+
+// AvgMatchLength returns the mean length of a match, or 0 without matches.
+func (s *Stats) AvgMatchLength() float64 {
+	if s.Matches == 0 {
+		return 0
+	}
+	return float64(s.MatchBytes) / float64(s.Matches)
+}
+
+// WithStats enables the block statistics returned by Stats. Without it the
+// decoder does not collect them.
+func WithStats(ok bool) Option {
+	return func(rb *ReaderBuilder) {
+		rb.collectStats = ok
+	}
+}
+
+// Stats returns the statistics of each member decoded so far by the reader
+// returned by Reader, the last of which may still be in progress. It returns
+// nil unless WithStats was given.
+func (rb *ReaderBuilder) Stats() []Stats {
+	if rb.d == nil {
+		return nil
+	}
+	return rb.d.stats
+}
+
+// startStats begins the statistics of a new member, when they are collected.
+func (d *decompressor) startStats() {
+	if d.rb == nil || !d.rb.collectStats {
+		return
+	}
+	d.stats = append(d.stats, Stats{})
+	d.st = &d.stats[len(d.stats)-1]
+}
@@ -0,0 +1,54 @@
+package hzip
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func TestStats(t *testing.T) {
+	text := fixture(t, "rfc1952.txt")
+	_, stats := decodeStats(t, fixture(t, "rfc1952.txt.gz"))
+	if len(stats) != 1 {
+		t.Fatalf("%d members, want 1", len(stats))
+	}
+	s := stats[0]
+	if s.StoredBlocks != 0 || s.FixedBlocks != 0 || s.DynamicBlocks != 1 {
+		t.Errorf("blocks: %d stored, %d fixed, %d dynamic; want one dynamic", s.StoredBlocks, s.FixedBlocks, s.DynamicBlocks)
+	}
+	if s.Literals+s.MatchBytes != int64(len(text)) {
+		t.Errorf("%d literals and %d match bytes, want %d in all", s.Literals, s.MatchBytes, len(text))
+	}
+	if got, want := s.AvgMatchLength(), float64(s.MatchBytes)/float64(s.Matches); got != want || got < minMatch {
+		t.Errorf("AvgMatchLength = %v, want %v", got, want)
+	}
+	if (&Stats{}).AvgMatchLength() != 0 {
+		t.Error("AvgMatchLength without matches is not 0")
+	}
+
+	// one entry per member
+	data := append(gzipData(t, text, gzip.NoCompression), gzipData(t, text[:100], gzip.BestCompression)...)
+	_, stats = decodeStats(t, data)
+	if len(stats) != 2 || stats[0].StoredBlocks == 0 || stats[1].StoredBlocks != 0 {
+		t.Errorf("stats of two members: %+v", stats)
+	}
+}
+
+func TestStatsDisabled(t *testing.T) {
+	rb, err := NewReaderBuilder(bytes.NewReader(fixture(t, "rfc1952.txt.gz")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := rb.Reader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.Copy(ioutil.Discard, r); err != nil {
+		t.Fatal(err)
+	}
+	if s := rb.Stats(); s != nil {
+		t.Errorf("Stats without WithStats = %+v, want nil", s)
+	}
+}
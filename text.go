@@ -0,0 +1,87 @@
+package hzip
+
+import (
+	"io"
+	"runtime"
+)
+
+// WithTextMode makes Reader and NewReader translate line endings to the host
+// convention, CRLF on Windows and LF elsewhere, when the first member's
+// header sets FTEXT. Data without FTEXT is never translated.
+func WithTextMode() Option {
+	return func(rb *ReaderBuilder) {
+		rb.textMode = true
+	}
+}
+
+// textReader translates the line endings of the text read from r.
+type textReader struct {
+	r    io.ReadCloser
+	crlf bool // whether LF becomes CRLF, rather than CRLF becoming LF
+	cr   bool // whether the last byte seen was CR
+	buf  [4096]byte
+	obuf []byte // backing array of out
+	out  []byte // translated bytes not yet returned
+	err  error
+}
+
+// wrapText wraps d in a textReader when text mode applies to the stream.
+func (rb *ReaderBuilder) wrapText(d *decompressor) io.ReadCloser {
+	if !rb.textMode || !rb.IsText {
+		return d
+	}
+	return &textReader{r: d, crlf: runtime.GOOS == "windows"}
+}
+
+func (t *textReader) Read(p []byte) (int, error) {
+	for len(t.out) == 0 {
+		if t.err != nil {
+			return 0, t.err
+		}
+		var n int
+		n, t.err = t.r.Read(t.buf[:])
+		t.translate(t.buf[:n])
+	}
+	n := copy(p, t.out)
+	t.out = t.out[n:]
+	return n, nil
+}
+
+// translate appends the translation of b to out. Converting to LF, a CR is
+// held back until the next byte shows whether it starts a CRLF.
+func (t *textReader) translate(b []byte) {
+	out := t.obuf[:0]
+	for _, c := range b {
+		switch {
+		case t.crlf:
+			if c == '\n' && !t.cr {
+				out = append(out, '\r')
+			}
+			out = append(out, c)
+			t.cr = c == '\r'
+		case t.cr:
+			t.cr = false
+			if c != '\n' {
+				out = append(out, '\r')
+			}
+			if c == '\r' {
+				t.cr = true
+				continue
+			}
+			out = append(out, c)
+		case c == '\r':
+			t.cr = true
+		default:
+			out = append(out, c)
+		}
+	}
+	if t.err != nil && t.cr && !t.crlf {
+		out = append(out, '\r')
+		t.cr = false
+	}
+	t.obuf, t.out = out, out
+}
+
+func (t *textReader) Close() error {
+	return t.r.Close()
+}
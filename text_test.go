@@ -0,0 +1,68 @@
+package hzip
+
+import (
+	"bytes"
+	"io/ioutil"
+	"runtime"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestTextTranslation(t *testing.T) {
+	tests := []struct {
+		in, lf, crlf string
+	}{
+		{"plain\nlf\n", "plain\nlf\n", "plain\r\nlf\r\n"},
+		{"dos\r\nlines\r\n", "dos\nlines\n", "dos\r\nlines\r\n"},
+		{"a\r\nb\r\n\r\r\nc\r", "a\nb\n\r\nc\r", "a\r\nb\r\n\r\r\nc\r"},
+		{"\r", "\r", "\r"},
+		{"\r\r\n\n", "\r\n\n", "\r\r\n\r\n"},
+		{"", "", ""},
+	}
+	for _, tt := range tests {
+		for _, crlf := range []bool{false, true} {
+			want := tt.lf
+			if crlf {
+				want = tt.crlf
+			}
+			// one byte at a time splits every CRLF across reads
+			for _, r := range []*textReader{
+				{r: ioutil.NopCloser(strings.NewReader(tt.in)), crlf: crlf},
+				{r: ioutil.NopCloser(iotest.OneByteReader(strings.NewReader(tt.in))), crlf: crlf},
+			} {
+				got, err := ioutil.ReadAll(r)
+				if err != nil || string(got) != want {
+					t.Errorf("%q, crlf %t: got %q, %v; want %q", tt.in, crlf, got, err, want)
+				}
+			}
+		}
+	}
+}
+
+func TestWithTextMode(t *testing.T) {
+	in := []byte("one\r\ntwo\nthree\r\n")
+	host := "one\ntwo\nthree\n"
+	if runtime.GOOS == "windows" {
+		host = "one\r\ntwo\r\nthree\r\n"
+	}
+	tests := []struct {
+		name   string
+		isText bool
+		opts   []Option
+		want   string
+	}{
+		{"FTEXT, text mode", true, []Option{WithTextMode()}, host},
+		{"FTEXT only", true, nil, string(in)},
+		{"text mode without FTEXT", false, []Option{WithTextMode()}, string(in)},
+	}
+	for _, tt := range tests {
+		r, err := NewReader(bytes.NewReader(writeHeader(t, Header{IsText: tt.isText}, in)), tt.opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := ioutil.ReadAll(r); err != nil || string(got) != tt.want {
+			t.Errorf("%s: got %q, %v; want %q", tt.name, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,370 @@
+package hzip
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+var (
+	ErrWriterClosed = errors.New("hunzip: write to closed writer")
+	ErrHeaderString = errors.New("hunzip: header name or comment is not NUL-free ISO 8859-1")
+	ErrExtraTooLong = errors.New("hunzip: extra field longer than 65535 bytes")
+)
+
+// Compression levels, with the same values as in compress/gzip.
+const (
+	NoCompression      = 0
+	BestSpeed          = 1
+	BestCompression    = 9
+	DefaultCompression = -1
+)
+
+// levelChain is the number of hash chain entries the match finder tries at
+// each compression level. Levels from lazyLevel on also look one byte ahead
+// for a longer match before taking one.
+var levelChain = [10]int{0, 4, 8, 16, 32, 64, defaultMaxChain, 256, 1024, 4096}
+
+const lazyLevel = 4
+
+// Writer compresses data written to it into a gzip stream. The Header fields
+// may be set before the first call to Write or Close; an XFL of 0 is replaced
+// by the value matching the compression level. Name and Comment are written
+// in ISO 8859-1, so they must not contain NUL or characters beyond U+00FF;
+// NameBytes and CommentBytes are ignored.
+type Writer struct {
+	Header
+
+	level       int
+	opts        []WriterOption
+	bw          *bitWriter
+	buf         []byte
+	m           *matcher
+	tokens      []token
+	wroteHeader bool
+	headerCRC   bool
+	closed      bool
+	crc         uint32
+	size        uint32
+
+	// full flushes every flushInterval input bytes, pending of which were
+	// written since the last point
+	flushInterval int
+	pending       int
+	in            int64
+	points        []FlushPoint
+}
+
+// WriterOption configures a Writer created by NewWriter or NewWriterLevel.
+type WriterOption func(*Writer)
+
+// WithHeaderCRC sets whether the header ends with the FHCRC checksum.
+func WithHeaderCRC(ok bool) WriterOption {
+	return func(z *Writer) {
+		z.headerCRC = ok
+	}
+}
+
+// WithOS sets the OS byte of the header. It defaults to 255, unknown, so that
+// the output does not depend on the platform it was written on.
+func WithOS(os byte) WriterOption {
+	return func(z *Writer) {
+		z.OS = os
+	}
+}
+
+// WithModTime sets the modification time of the header. By default MTIME is
+// zero, meaning no time is recorded, so that the output is reproducible.
+func WithModTime(t time.Time) WriterOption {
+	return func(z *Writer) {
+		z.ModTime = t
+	}
+}
+
+// NewWriter returns a Writer that writes a gzip stream to w. The stream is
+// only complete once Close has been called.
+func NewWriter(w io.Writer, opts ...WriterOption) *Writer {
+	z, _ := NewWriterLevel(w, DefaultCompression, opts...)
+	return z
+}
+
+// NewWriterLevel is like NewWriter but uses the given compression level,
+// from NoCompression, which only writes stored blocks, through BestSpeed to
+// BestCompression, or DefaultCompression.
+func NewWriterLevel(w io.Writer, level int, opts ...WriterOption) (*Writer, error) {
+	if level == DefaultCompression {
+		level = 6
+	}
+	if level < NoCompression || level > BestCompression {
+		return nil, fmt.Errorf("hunzip: invalid compression level: %d", level)
+	}
+	z := &Writer{
+		Header: Header{OS: 255},
+		level:  level,
+		opts:   opts,
+		bw:     newBitWriter(w),
+	}
+	if level > NoCompression {
+		z.m = newMatcher(levelChain[level])
+		z.m.lazy = level >= lazyLevel
+	}
+	for _, opt := range opts {
+		opt(z)
+	}
+	return z, nil
+}
+
+// Reset discards the state of z and makes it write a new stream to w, as if
+// it had just been returned by NewWriterLevel with the same level and
+// options, while keeping its buffers. The Header is cleared and then set
+// again by the options, so fields assigned directly must be assigned again
+// for every stream.
+func (z *Writer) Reset(w io.Writer) {
+	bw, m := z.bw, z.m
+	*bw = bitWriter{w: w, buf: bw.buf[:0]}
+	if m != nil {
+		m.reset()
+	}
+	*z = Writer{
+		Header: Header{OS: 255},
+		level:  z.level,
+		opts:   z.opts,
+		bw:     bw,
+		buf:    z.buf[:0],
+		m:      m,
+		tokens: z.tokens[:0],
+	}
+	for _, opt := range z.opts {
+		opt(z)
+	}
+}
+
+// headerString returns the ISO 8859-1 bytes of a name or comment.
+func headerString(s string) ([]byte, error) {
+	var b []byte
+	for _, r := range s {
+		if r == 0x00 || r > 0xff {
+			return nil, ErrHeaderString
+		}
+		b = append(b, byte(r))
+	}
+	return b, nil
+}
+
+// writeHeader writes the member header. A header that cannot be encoded fails
+// every later write.
+func (z *Writer) writeHeader() error {
+	z.wroteHeader = true
+	name, err := headerString(z.Name)
+	if err != nil {
+		z.bw.err = err
+		return err
+	}
+	comment, err := headerString(z.Comment)
+	if err != nil {
+		z.bw.err = err
+		return err
+	}
+	if len(z.Extra) > 0xffff {
+		z.bw.err = ErrExtraTooLong
+		return z.bw.err
+	}
+
+	var flg byte
+	if z.IsText {
+		flg |= FTEXT
+	}
+	if z.Extra != nil {
+		flg |= FEXTRA
+	}
+	if len(name) > 0 {
+		flg |= FNAME
+	}
+	if len(comment) > 0 {
+		flg |= FCOMMENT
+	}
+	if z.headerCRC {
+		flg |= FHCRC
+	}
+	xfl := z.XFL
+	if xfl == 0 {
+		switch z.level {
+		case BestCompression:
+			xfl = 2
+		case BestSpeed:
+			xfl = 4
+		}
+	}
+	header := []byte{0x1f, 0x8b, 8, flg, 0, 0, 0, 0, xfl, z.OS}
+	if t := z.ModTime; t.Unix() > 0 {
+		le.PutUint32(header[4:8], uint32(t.Unix()))
+	}
+	if z.Extra != nil {
+		var xlen [2]byte
+		le.PutUint16(xlen[:], uint16(len(z.Extra)))
+		header = append(header, xlen[:]...)
+		header = append(header, z.Extra...)
+	}
+	if len(name) > 0 {
+		header = append(append(header, name...), 0x00)
+	}
+	if len(comment) > 0 {
+		header = append(append(header, comment...), 0x00)
+	}
+	if z.headerCRC {
+		var crc16 [2]byte
+		le.PutUint16(crc16[:], uint16(CRC32(header)))
+		header = append(header, crc16[:]...)
+	}
+	z.bw.writeBytes(header)
+	return nil
+}
+
+// Write compresses p. Data is buffered and only written out once a full block
+// is available.
+func (z *Writer) Write(p []byte) (int, error) {
+	if z.closed {
+		return 0, ErrWriterClosed
+	}
+	if !z.wroteHeader {
+		if err := z.writeHeader(); err != nil {
+			return 0, err
+		}
+	}
+	z.crc = UpdateCRC32(z.crc, p)
+	z.size += uint32(len(p))
+
+	n := len(p)
+	for len(p) > 0 {
+		m := z.room()
+		if m > len(p) {
+			m = len(p)
+		}
+		z.buf = append(z.buf, p[:m]...)
+		p = p[m:]
+		if err := z.advance(m); err != nil {
+			return 0, err
+		}
+	}
+	return n, nil
+}
+
+// room returns how many bytes can be buffered before the next block or flush
+// point.
+func (z *Writer) room() int {
+	m := maxStoredBlockSize - len(z.buf)
+	if z.flushInterval > 0 && z.flushInterval-z.pending < m {
+		m = z.flushInterval - z.pending
+	}
+	return m
+}
+
+// advance accounts for n bytes just buffered, writing a block or a flush
+// point once room is exhausted.
+func (z *Writer) advance(n int) error {
+	z.in += int64(n)
+	if z.flushInterval > 0 {
+		z.pending += n
+		if z.pending == z.flushInterval {
+			return z.fullFlush()
+		}
+	}
+	if len(z.buf) == maxStoredBlockSize {
+		return z.writeBlock(false)
+	}
+	return nil
+}
+
+// ReadFrom compresses the data read from r until io.EOF, reading directly
+// into the block buffer. Like Write, it does not end the stream; call Close
+// afterwards.
+func (z *Writer) ReadFrom(r io.Reader) (int64, error) {
+	if z.closed {
+		return 0, ErrWriterClosed
+	}
+	if !z.wroteHeader {
+		if err := z.writeHeader(); err != nil {
+			return 0, err
+		}
+	}
+	if cap(z.buf) < maxStoredBlockSize {
+		buf := make([]byte, len(z.buf), maxStoredBlockSize)
+		copy(buf, z.buf)
+		z.buf = buf
+	}
+
+	var total int64
+	for {
+		n, err := r.Read(z.buf[len(z.buf) : len(z.buf)+z.room()])
+		p := z.buf[len(z.buf) : len(z.buf)+n]
+		z.crc = UpdateCRC32(z.crc, p)
+		z.size += uint32(n)
+		z.buf = z.buf[:len(z.buf)+n]
+		total += int64(n)
+		if werr := z.advance(n); werr != nil {
+			return total, werr
+		}
+		if err == io.EOF {
+			return total, nil
+		}
+		if err != nil {
+			return total, err
+		}
+	}
+}
+
+// Flush writes out the buffered data followed by an empty stored block, so
+// that a decoder can return everything written so far, and flushes the
+// underlying writer's input. The stream stays open.
+func (z *Writer) Flush() error {
+	if z.closed {
+		return ErrWriterClosed
+	}
+	if !z.wroteHeader {
+		if err := z.writeHeader(); err != nil {
+			return err
+		}
+	}
+	if len(z.buf) > 0 {
+		if err := z.writeBlock(false); err != nil {
+			return err
+		}
+	}
+	writeStoredBlock(z.bw, nil, false)
+	return z.bw.flush()
+}
+
+// writeBlock compresses the buffered data into a block.
+func (z *Writer) writeBlock(final bool) error {
+	if z.level == NoCompression {
+		writeStoredBlock(z.bw, z.buf, final)
+	} else {
+		z.tokens = z.m.tokenize(z.buf, z.tokens[:0])
+		writeCompressedBlock(z.bw, z.buf, z.tokens, final)
+	}
+	z.buf = z.buf[:0]
+	return z.bw.flush()
+}
+
+// Close writes the remaining data as the final block followed by the
+// trailer. It does not close the underlying writer.
+func (z *Writer) Close() error {
+	if z.closed {
+		return z.bw.err
+	}
+	z.closed = true
+	if !z.wroteHeader {
+		if err := z.writeHeader(); err != nil {
+			return err
+		}
+	}
+	z.writeBlock(true)
+	z.bw.align()
+
+	var trailer [8]byte
+	le.PutUint32(trailer[0:4], z.crc)
+	le.PutUint32(trailer[4:8], z.size)
+	z.bw.writeBytes(trailer[:])
+	return z.bw.flush()
+}
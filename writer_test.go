@@ -0,0 +1,526 @@
+package hzip
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+// writerInputs returns data of various sizes and compressibility for
+// round-trip tests.
+func writerInputs(tb testing.TB) map[string][]byte {
+	text := fixture(tb, "rfc1952.txt")
+	random := make([]byte, 100000)
+	rand.New(rand.NewSource(23)).Read(random)
+	return map[string][]byte{
+		"empty":  nil,
+		"byte":   []byte("x"),
+		"text":   text,
+		"repeat": bytes.Repeat(text, 8),
+		"random": random,
+		"zeros":  make([]byte, 200000),
+	}
+}
+
+// compress writes data to a Writer of the given level in chunks of n bytes.
+func compress(tb testing.TB, data []byte, level, n int) []byte {
+	tb.Helper()
+	var b bytes.Buffer
+	w, err := NewWriterLevel(&b, level)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	for len(data) > 0 {
+		m := n
+		if m > len(data) {
+			m = len(data)
+		}
+		if _, err := w.Write(data[:m]); err != nil {
+			tb.Fatal(err)
+		}
+		data = data[m:]
+	}
+	if err := w.Close(); err != nil {
+		tb.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+// gunzip decodes data with compress/gzip.
+func gunzip(tb testing.TB, data []byte) []byte {
+	tb.Helper()
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	out, err := ioutil.ReadAll(r)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return out
+}
+
+func TestWriterHeaderRoundTrip(t *testing.T) {
+	var b bytes.Buffer
+	w := NewWriter(&b)
+	w.Name = "café.txt"
+	w.Comment = "ünïcode comment"
+	w.Extra = []byte{'A', 'B', 2, 0, 7, 8}
+	w.ModTime = time.Unix(1234567890, 0)
+	w.OS = 3
+	w.IsText = true
+	if _, err := w.Write([]byte("body")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	rb, err := NewReaderBuilder(bytes.NewReader(b.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rb.Name != w.Name || rb.Comment != w.Comment {
+		t.Errorf("name, comment = %q, %q, want %q, %q", rb.Name, rb.Comment, w.Name, w.Comment)
+	}
+	if !bytes.Equal(rb.NameBytes, []byte("caf\xe9.txt")) {
+		t.Errorf("NameBytes = %q, want ISO 8859-1 %q", rb.NameBytes, "caf\xe9.txt")
+	}
+	if !bytes.Equal(rb.Extra, w.Extra) || !rb.ModTime.Equal(w.ModTime) || rb.OS != 3 || !rb.IsText {
+		t.Errorf("header = %+v", rb.Header)
+	}
+}
+
+func TestWriterHeaderFromReader(t *testing.T) {
+	rb, err := NewReaderBuilder(bytes.NewReader(fixture(t, "allflags.gz")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	w := NewWriter(&b)
+	w.Header = rb.Header
+	w.Name = "new.txt"
+	w.Close()
+
+	rb2, err := NewReaderBuilder(bytes.NewReader(b.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rb2.Name != "new.txt" || rb2.Comment != rb.Comment {
+		t.Errorf("name, comment = %q, %q, want %q, %q", rb2.Name, rb2.Comment, "new.txt", rb.Comment)
+	}
+}
+
+func TestWriterHeaderString(t *testing.T) {
+	for _, name := range []string{"nul\x00", "snow☃man", "bad\xffutf8"} {
+		w := NewWriter(new(bytes.Buffer))
+		w.Name = name
+		if _, err := w.Write([]byte("x")); err != ErrHeaderString {
+			t.Errorf("name %q: Write error %v, want ErrHeaderString", name, err)
+		}
+	}
+}
+
+func TestWriterRoundTrip(t *testing.T) {
+	for name, data := range writerInputs(t) {
+		for _, n := range []int{1 << 20, 1000, 7} {
+			if n < 1000 && len(data) > 10000 {
+				continue
+			}
+			gz := compress(t, data, DefaultCompression, n)
+			got, err := decodeAll(gz)
+			if err != nil || !bytes.Equal(got, data) {
+				t.Errorf("%s in %d-byte writes: decoded %d bytes, %v; want %d", name, n, len(got), err, len(data))
+			}
+			if got := gunzip(t, gz); !bytes.Equal(got, data) {
+				t.Errorf("%s in %d-byte writes: compress/gzip decoded %d bytes, want %d", name, n, len(got), len(data))
+			}
+		}
+	}
+}
+
+func TestWriterClosed(t *testing.T) {
+	w := NewWriter(new(bytes.Buffer))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("late")); err != ErrWriterClosed {
+		t.Errorf("Write after Close: error %v, want ErrWriterClosed", err)
+	}
+	if err := w.Flush(); err != ErrWriterClosed {
+		t.Errorf("Flush after Close: error %v, want ErrWriterClosed", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Errorf("second Close: %v", err)
+	}
+}
+
+func TestWriterDynamicBlocks(t *testing.T) {
+	text := fixture(t, "rfc1952.txt")
+	gz := compress(t, text, DefaultCompression, len(text))
+	out, stats := decodeStats(t, gz)
+	if !bytes.Equal(out, text) {
+		t.Fatalf("decoded %d bytes, want %d", len(out), len(text))
+	}
+	if len(stats) != 1 || stats[0].DynamicBlocks == 0 {
+		t.Errorf("stats %+v, want dynamic blocks", stats)
+	}
+	if stored := compress(t, text, NoCompression, len(text)); len(gz) >= len(stored)/2 {
+		t.Errorf("compressed to %d bytes, stored blocks take %d", len(gz), len(stored))
+	}
+}
+
+func TestWriterLevels(t *testing.T) {
+	text := bytes.Repeat(fixture(t, "rfc1952.txt"), 2)
+	sizes := make([]int, BestCompression+1)
+	for level := NoCompression; level <= BestCompression; level++ {
+		gz := compress(t, text, level, len(text))
+		if got, err := decodeAll(gz); err != nil || !bytes.Equal(got, text) {
+			t.Errorf("level %d: decoded %d bytes, %v", level, len(got), err)
+		}
+		sizes[level] = len(gz)
+	}
+	if !(sizes[BestCompression] <= sizes[6] && sizes[6] <= sizes[BestSpeed] && sizes[BestSpeed] < sizes[NoCompression]) {
+		t.Errorf("sizes by level %v do not shrink with the level", sizes)
+	}
+	if sizes[NoCompression] < len(text) {
+		t.Errorf("level 0 wrote %d bytes for %d of input", sizes[NoCompression], len(text))
+	}
+	if z, err := NewWriterLevel(new(bytes.Buffer), DefaultCompression); err != nil || z.level != 6 {
+		t.Errorf("DefaultCompression: %v", err)
+	}
+	for _, level := range []int{-2, 10} {
+		if _, err := NewWriterLevel(new(bytes.Buffer), level); err == nil {
+			t.Errorf("level %d: no error", level)
+		}
+	}
+}
+
+func TestWriterFlush(t *testing.T) {
+	var b bytes.Buffer
+	w := NewWriter(&b)
+	parts := []string{"first part, ", "second part, ", "", "last part"}
+	var want string
+	for _, p := range parts {
+		w.Write([]byte(p))
+		if err := w.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		want += p
+
+		// everything written so far can be decoded from what is out
+		r, err := NewReader(bytes.NewReader(b.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make([]byte, len(want))
+		if _, err := io.ReadFull(r, got); err != nil || string(got) != want {
+			t.Errorf("after flushing %q: decoded %q, %v", p, got, err)
+		}
+		zr, err := gzip.NewReader(bytes.NewReader(b.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadFull(zr, got); err != nil || string(got) != want {
+			t.Errorf("after flushing %q: compress/gzip decoded %q, %v", p, got, err)
+		}
+	}
+	w.Close()
+	if got, err := decodeAll(b.Bytes()); err != nil || string(got) != want {
+		t.Errorf("whole stream: decoded %q, %v", got, err)
+	}
+}
+
+func TestWriterSmallBlocks(t *testing.T) {
+	for _, in := range []string{"a", "hello", "hello hello hello", "\x00\x01\x02\x03"} {
+		gz := compress(t, []byte(in), DefaultCompression, len(in))
+		out, stats := decodeStats(t, gz)
+		if string(out) != in {
+			t.Errorf("%q: decoded %q", in, out)
+		}
+		if len(stats) != 1 || stats[0].DynamicBlocks != 0 {
+			t.Errorf("%q: stats %+v, want fixed or stored blocks", in, stats)
+		}
+
+		// the same tokens forced into a dynamic block
+		tokens := newMatcher(defaultMaxChain).tokenize([]byte(in), nil)
+		lit, dist := tokenFreqs(tokens)
+		h := newDynamicHeader(lit[:], dist[:])
+		var b bytes.Buffer
+		bw := newBitWriter(&b)
+		h.write(bw, true)
+		writeTokens(bw, tokens, h.lit, h.dist)
+		bw.align()
+		bw.flush()
+		// 10 header and 8 trailer bytes surround the block
+		if block := len(gz) - 18; block >= b.Len() {
+			t.Errorf("%q: %d-byte block, a dynamic one takes %d", in, block, b.Len())
+		}
+	}
+}
+
+func TestWriterHeaderCRC(t *testing.T) {
+	for _, on := range []bool{false, true} {
+		var b bytes.Buffer
+		w := NewWriter(&b, WithHeaderCRC(on))
+		w.Name = "crc.txt"
+		w.Comment = "with a comment"
+		w.Write([]byte("data"))
+		w.Close()
+		data := b.Bytes()
+
+		if got := data[3]&FHCRC != 0; got != on {
+			t.Errorf("WithHeaderCRC(%t): FHCRC flag %t", on, got)
+		}
+		rb, err := NewReaderBuilder(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("WithHeaderCRC(%t): %v", on, err)
+		}
+		if on {
+			n := 10 + len("crc.txt\x00with a comment\x00")
+			if want := int(uint16(CRC32(data[:n]))); rb.CRC16 != want || int(le.Uint16(data[n:])) != want {
+				t.Errorf("CRC16 = %04x, want %04x", rb.CRC16, want)
+			}
+		}
+		// compress/gzip verifies FHCRC as well
+		if got := gunzip(t, data); string(got) != "data" {
+			t.Errorf("WithHeaderCRC(%t): compress/gzip decoded %q", on, got)
+		}
+	}
+}
+
+func TestWriterOS(t *testing.T) {
+	tests := []struct {
+		opts []WriterOption
+		want byte
+	}{
+		{nil, 255},
+		{[]WriterOption{WithOS(3)}, 3},
+		{[]WriterOption{WithOS(0)}, 0},
+		{[]WriterOption{WithOS(11)}, 11},
+	}
+	for _, tt := range tests {
+		var b bytes.Buffer
+		w := NewWriter(&b, tt.opts...)
+		w.Close()
+		if got := b.Bytes()[9]; got != tt.want {
+			t.Errorf("OS byte = %d, want %d", got, tt.want)
+		}
+		rb, err := NewReaderBuilder(bytes.NewReader(b.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rb.OS != tt.want {
+			t.Errorf("reader OS = %d, want %d", rb.OS, tt.want)
+		}
+	}
+}
+
+func TestWriterReproducible(t *testing.T) {
+	text := fixture(t, "rfc1952.txt")
+	run := func(opts ...WriterOption) []byte {
+		var b bytes.Buffer
+		w := NewWriter(&b, opts...)
+		w.Name = "rfc1952.txt"
+		w.Write(text)
+		w.Close()
+		return b.Bytes()
+	}
+	first, second := run(), run()
+	if !bytes.Equal(first, second) {
+		t.Error("two runs with the same input differ")
+	}
+	if mtime := le.Uint32(first[4:8]); mtime != 0 {
+		t.Errorf("default MTIME = %d, want 0", mtime)
+	}
+	rb, err := NewReaderBuilder(bytes.NewReader(first))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rb.HasModTime() {
+		t.Errorf("reader reports a timestamp %v", rb.ModTime)
+	}
+
+	when := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	pinned := run(WithModTime(when))
+	if !bytes.Equal(pinned, run(WithModTime(when))) {
+		t.Error("two runs with the same WithModTime differ")
+	}
+	if mtime := le.Uint32(pinned[4:8]); int64(mtime) != when.Unix() {
+		t.Errorf("MTIME = %d, want %d", mtime, when.Unix())
+	}
+}
+
+func TestFlushPoints(t *testing.T) {
+	text := fixture(t, "rfc1952.txt")
+	var b bytes.Buffer
+	w := NewWriter(&b, WithFlushInterval(4096))
+	w.Write(text)
+	w.Close()
+	points := w.FlushPoints()
+	if want := len(text) / 4096; len(points) != want {
+		t.Fatalf("%d flush points, want %d", len(points), want)
+	}
+	if got := gunzip(t, b.Bytes()); !bytes.Equal(got, text) {
+		t.Fatalf("whole stream decoded to %d bytes, want %d", len(got), len(text))
+	}
+
+	for _, i := range []int{0, len(points) / 2, len(points) - 1} {
+		p := points[i]
+		if p.In != int64(i+1)*4096 {
+			t.Errorf("point %d at input offset %d, want %d", i, p.In, (i+1)*4096)
+		}
+		r, err := NewFlushPointReader(bytes.NewReader(b.Bytes()), p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("point %d: %v", i, err)
+		}
+		if !bytes.Equal(got, text[p.In:]) {
+			t.Errorf("point %d: decoded %d bytes, want the %d from input offset %d", i, len(got), len(text)-int(p.In), p.In)
+		}
+	}
+}
+
+func TestWriterXFL(t *testing.T) {
+	tests := []struct {
+		level int
+		xfl   byte
+		want  byte
+	}{
+		{BestCompression, 0, 2},
+		{BestSpeed, 0, 4},
+		{DefaultCompression, 0, 0},
+		{NoCompression, 0, 0},
+		{BestSpeed, 2, 2},
+	}
+	for _, tt := range tests {
+		var b bytes.Buffer
+		w, err := NewWriterLevel(&b, tt.level)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.XFL = tt.xfl
+		w.Write([]byte("extra flags"))
+		w.Close()
+		if got := b.Bytes()[8]; got != tt.want {
+			t.Errorf("level %d, XFL %d: wrote XFL %d, want %d", tt.level, tt.xfl, got, tt.want)
+		}
+		rb, err := NewReaderBuilder(bytes.NewReader(b.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rb.XFL != tt.want {
+			t.Errorf("level %d, XFL %d: reader XFL %d, want %d", tt.level, tt.xfl, rb.XFL, tt.want)
+		}
+	}
+}
+
+func TestWriterReset(t *testing.T) {
+	text := fixture(t, "rfc1952.txt")
+	when := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	opts := []WriterOption{WithOS(3), WithModTime(when), WithHeaderCRC(true)}
+
+	var first, second bytes.Buffer
+	w, err := NewWriterLevel(&first, BestCompression, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Name = "first"
+	w.Write(text)
+	w.Close()
+
+	w.Reset(&second)
+	w.Write(text[:1000])
+	w.Close()
+
+	// the second stream is what a fresh writer with the same level and
+	// options writes
+	var want bytes.Buffer
+	fresh, _ := NewWriterLevel(&want, BestCompression, opts...)
+	fresh.Write(text[:1000])
+	fresh.Close()
+	if !bytes.Equal(second.Bytes(), want.Bytes()) {
+		t.Error("stream after Reset differs from a new writer's")
+	}
+
+	for i, tt := range []struct {
+		data []byte
+		name string
+		want []byte
+	}{
+		{first.Bytes(), "first", text},
+		{second.Bytes(), "", text[:1000]},
+	} {
+		rb, err := NewReaderBuilder(bytes.NewReader(tt.data))
+		if err != nil {
+			t.Fatalf("stream %d: %v", i, err)
+		}
+		if rb.Name != tt.name || rb.OS != 3 || !rb.ModTime.Equal(when) || rb.XFL != 2 {
+			t.Errorf("stream %d: header %+v", i, rb.Header)
+		}
+		if got := gunzip(t, tt.data); !bytes.Equal(got, tt.want) {
+			t.Errorf("stream %d: decoded %d bytes, want %d", i, len(got), len(tt.want))
+		}
+	}
+}
+
+func TestWriterReadFrom(t *testing.T) {
+	text := fixture(t, "rfc1952.txt")
+	random := make([]byte, 200000)
+	rand.New(rand.NewSource(58)).Read(random)
+	// several blocks of maxStoredBlockSize, read in pieces that do not line
+	// up with them
+	big := bytes.Repeat(text, 10)
+	for _, tt := range []struct {
+		name  string
+		data  []byte
+		level int
+		opts  []WriterOption
+	}{
+		{"text", big, DefaultCompression, nil},
+		{"random", random, BestSpeed, nil},
+		{"stored", big, NoCompression, nil},
+		{"flush points", big, DefaultCompression, []WriterOption{WithFlushInterval(50000)}},
+	} {
+		var b bytes.Buffer
+		w, err := NewWriterLevel(&b, tt.level, tt.opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := io.Copy(w, iotest.HalfReader(bytes.NewReader(tt.data)))
+		if err != nil || n != int64(len(tt.data)) {
+			t.Fatalf("%s: copied %d bytes, %v", tt.name, n, err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if got := gunzip(t, b.Bytes()); !bytes.Equal(got, tt.data) {
+			t.Errorf("%s: decoded %d bytes, want %d", tt.name, len(got), len(tt.data))
+		}
+	}
+
+	// ReadFrom, then Write, then Close continue the same stream
+	var b bytes.Buffer
+	w := NewWriter(&b)
+	w.Write(text[:100])
+	if _, err := w.ReadFrom(bytes.NewReader(big)); err != nil {
+		t.Fatal(err)
+	}
+	w.Write(text)
+	w.Close()
+	want := append(append(append([]byte(nil), text[:100]...), big...), text...)
+	if got := gunzip(t, b.Bytes()); !bytes.Equal(got, want) {
+		t.Errorf("ReadFrom then Write: decoded %d bytes, want %d", len(got), len(want))
+	}
+	if _, err := w.ReadFrom(bytes.NewReader(text)); err != ErrWriterClosed {
+		t.Errorf("ReadFrom after Close: error %v, want ErrWriterClosed", err)
+	}
+}
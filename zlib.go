@@ -0,0 +1,55 @@
+package hzip
+
+import (
+	"encoding/binary"
+	"hash/adler32"
+	"io"
+)
+
+const zlibFDICT = 1 << 5
+
+// NewZlibReader returns a reader that decodes a zlib stream as defined by
+// RFC 1950: a 2-byte header, a DEFLATE body and an Adler-32 trailer. A stream
+// that needs a preset dictionary fails with ErrDictionary unless it is given
+// with WithDictionary, and with ErrBadDictionary if it does not match.
+func NewZlibReader(r io.Reader, opts ...Option) (io.Reader, error) {
+	cfg := applyOptions(opts)
+	rr := &countingReader{r: cfg.newBuffer(r)}
+	var h [2]byte
+	if _, err := io.ReadFull(rr, h[:]); err != nil {
+		return nil, &HeaderError{Err: err}
+	}
+	cmf, flg := h[0], h[1]
+	if cmf&0x0f != 8 || cmf>>4 > 7 || (uint(cmf)<<8|uint(flg))%31 != 0 {
+		return nil, ErrBadHeader
+	}
+	d := &decompressor{r: rr, adler: adler32.New(), max: cfg.MaxOutputSize}
+	if flg&zlibFDICT != 0 {
+		var dictID [4]byte
+		if _, err := io.ReadFull(rr, dictID[:]); err != nil {
+			return nil, &HeaderError{Err: noEOF(err)}
+		}
+		if cfg.dict == nil {
+			return nil, ErrDictionary
+		}
+		if binary.BigEndian.Uint32(dictID[:]) != Adler32(cfg.dict) {
+			return nil, ErrBadDictionary
+		}
+		d.dict = cfg.dict
+	}
+	return d, nil
+}
+
+// finishZlib verifies the big-endian Adler-32 trailer of a zlib stream.
+func (d *decompressor) finishZlib() error {
+	d.br.align()
+	b, err := d.br.readBytes(4)
+	if err != nil {
+		return err
+	}
+	sum := binary.BigEndian.Uint32(b)
+	if computed := d.adler.Sum32(); sum != computed {
+		return &ChecksumError{Expected: sum, Computed: computed}
+	}
+	return io.EOF
+}
@@ -0,0 +1,94 @@
+package hzip
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+// zlibData compresses data with compress/zlib at the given level.
+func zlibData(tb testing.TB, data []byte, level int) []byte {
+	tb.Helper()
+	var b bytes.Buffer
+	w, err := zlib.NewWriterLevel(&b, level)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		tb.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		tb.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+// unzlib decodes a whole zlib stream through NewZlibReader.
+func unzlib(data []byte, opts ...Option) ([]byte, error) {
+	r, err := NewZlibReader(bytes.NewReader(data), opts...)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+func TestZlibReader(t *testing.T) {
+	text := fixture(t, "rfc1952.txt")
+	for _, level := range []int{zlib.NoCompression, zlib.BestSpeed, zlib.DefaultCompression, zlib.BestCompression} {
+		got, err := unzlib(zlibData(t, text, level))
+		if err != nil || !bytes.Equal(got, text) {
+			t.Errorf("level %d: decoded %d bytes, %v; want %d", level, len(got), err, len(text))
+		}
+	}
+
+	data := zlibData(t, text, zlib.DefaultCompression)
+	tests := []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{"bad FCHECK", tamper(data, 1, 0x01), ErrBadHeader},
+		{"bad method", tamper(data, 0, 0x01), ErrBadHeader},
+		{"window too large", []byte{0x88, 0x1c}, ErrBadHeader},
+		{"truncated header", data[:1], ErrBadHeader},
+		{"bad Adler-32", tamper(data, -1, 0x01), ErrChecksum},
+		{"truncated trailer", data[:len(data)-2], io.ErrUnexpectedEOF},
+	}
+	for _, tt := range tests {
+		if _, err := unzlib(tt.data); !errors.Is(err, tt.err) {
+			t.Errorf("%s: error %v, want %v", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestZlibDictionary(t *testing.T) {
+	text := fixture(t, "rfc1952.txt")
+	dict := text[:2000]
+	var b bytes.Buffer
+	w, err := zlib.NewWriterLevelDict(&b, zlib.BestCompression, dict)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(text[:3000])
+	w.Close()
+	data := b.Bytes()
+
+	got, err := unzlib(data, WithDictionary(dict))
+	if err != nil || !bytes.Equal(got, text[:3000]) {
+		t.Errorf("matching dictionary: decoded %d bytes, %v", len(got), err)
+	}
+	if _, err := unzlib(data); err != ErrDictionary {
+		t.Errorf("no dictionary: error %v, want ErrDictionary", err)
+	}
+	if _, err := unzlib(data, WithDictionary(text[1:2001])); err != ErrBadDictionary {
+		t.Errorf("wrong dictionary: error %v, want ErrBadDictionary", err)
+	}
+	// a stream without FDICT does not use a dictionary that is given
+	got, err = unzlib(zlibData(t, text, zlib.DefaultCompression), WithDictionary(dict))
+	if err != nil || !bytes.Equal(got, text) {
+		t.Errorf("dictionary without FDICT: decoded %d bytes, %v", len(got), err)
+	}
+}